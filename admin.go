@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+// startedAt is when the process started
+var startedAt = time.Now()
+
+// newAdminMux creates the handler for the admin listener: the dashboard, which
+// has its own authentication, and the management API serving everything else.
+// None of these paths are routed by the public listener, which only serves
+// the routes of newRouter. Importing net/http/pprof also registers its
+// handlers on http.DefaultServeMux, which no listener serves.
+func newAdminMux(api http.Handler, dashboard http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	if dashboard != nil {
+		mux.Handle(dashboardPath, dashboard)
+	}
+	return mux
+}
+
+// newAdminRouter creates the router of the management API: incidents, node
+// management, uptime exports, metrics, webhook deliveries, the health sink,
+// config reloads and runtime diagnostics. It's served on the admin listener
+// without CORS headers, and its routes require an API key with the scope
+// listed in routeScopes. Probe results are weighted by up to uptimeMaxGap
+// each in uptime exports.
+func newAdminRouter(authMiddleware middlewareFunc, db *sql.DB, uptimeMaxGap time.Duration, metrics *prometheusSink, healthSink http.Handler, reload http.Handler, debug http.Handler) *web.Router {
+	router := web.New(Context{}).
+		Middleware((*Context).HealthCheck).
+		Middleware(web.LoggerMiddleware).
+		Middleware(web.ShowErrorsMiddleware)
+
+	router.Subrouter(Context{}, "").
+		Middleware((*Context).NameJob).
+		Middleware(authMiddleware).
+		Get("/incidents", newListIncidentsHandler(db)).
+		Get("/nodes/:ip", newNodeDetailHandler(db)).
+		Delete("/nodes/:ip", newDeleteNodeHandler(db)).
+		Get("/nodes/:ip/uptime", newNodeUptimeHandler(db, uptimeMaxGap)).
+		Get("/fleet/uptime", newFleetUptimeHandler(db, uptimeMaxGap)).
+		Get("/metrics", newMetricsHandler(metrics, db)).
+		Get("/webhooks/deliveries", newListWebhookDeliveriesHandler(db)).
+		Post("/webhooks/deliveries/:id/replay", newReplayWebhookDeliveryHandler(db)).
+		Get("/health", serveHandler(healthSink)).
+		Post("/config/reload", serveHandler(reload)).
+		Get("/debug/:*", serveHandler(debug)).
+		Post("/debug/:*", serveHandler(debug))
+
+	return router
+}
+
+// serveHandler adapts an http.Handler to a route
+func serveHandler(h http.Handler) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		h.ServeHTTP(rw, req.Request)
+	}
+}
+
+// newDebugHandler returns the handler of the runtime diagnostics: pprof
+// profiles under /debug/pprof/ and runtime statistics at /debug/runtime
+func newDebugHandler(db *sql.DB) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/runtime", newRuntimeStatsHandler(db))
+	return mux
+}
+
+// runtimeStats describes the state of the process
+type runtimeStats struct {
+	Version       *versionInfo         `json:"version"`
+	StartedAt     time.Time            `json:"started_at"`
+	UptimeSeconds int64                `json:"uptime_seconds"`
+	Goroutines    int                  `json:"goroutines"`
+	GOMAXPROCS    int                  `json:"gomaxprocs"`
+	NumCPU        int                  `json:"num_cpu"`
+	Memory        memoryStats          `json:"memory"`
+	DB            dbPoolStats          `json:"db"`
+	Upstream      upstreamPoolSnapshot `json:"upstream"`
+}
+
+// memoryStats are the memory allocator and GC statistics of the process
+type memoryStats struct {
+	AllocBytes      uint64     `json:"alloc_bytes"`
+	TotalAllocBytes uint64     `json:"total_alloc_bytes"`
+	SysBytes        uint64     `json:"sys_bytes"`
+	HeapInuseBytes  uint64     `json:"heap_inuse_bytes"`
+	HeapIdleBytes   uint64     `json:"heap_idle_bytes"`
+	HeapObjects     uint64     `json:"heap_objects"`
+	StackInuseBytes uint64     `json:"stack_inuse_bytes"`
+	Mallocs         uint64     `json:"mallocs"`
+	Frees           uint64     `json:"frees"`
+	NumGC           uint32     `json:"num_gc"`
+	GCPauseTotalMs  float64    `json:"gc_pause_total_ms"`
+	LastGC          *time.Time `json:"last_gc,omitempty"`
+}
+
+// dbPoolStats are the connection pool statistics of the database
+type dbPoolStats struct {
+	MaxOpenConns      int     `json:"max_open_conns"`
+	OpenConns         int     `json:"open_conns"`
+	InUse             int     `json:"in_use"`
+	Idle              int     `json:"idle"`
+	WaitCount         int64   `json:"wait_count"`
+	WaitDurationMs    float64 `json:"wait_duration_ms"`
+	MaxIdleClosed     int64   `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64   `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64   `json:"max_lifetime_closed"`
+}
+
+// newRuntimeStatsHandler returns a handler that reports runtime statistics
+func newRuntimeStatsHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		dbStats := db.Stats()
+
+		stats := &runtimeStats{
+			Version:       buildVersion(),
+			StartedAt:     startedAt,
+			UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+			Goroutines:    runtime.NumGoroutine(),
+			GOMAXPROCS:    runtime.GOMAXPROCS(0),
+			NumCPU:        runtime.NumCPU(),
+			Memory: memoryStats{
+				AllocBytes:      mem.Alloc,
+				TotalAllocBytes: mem.TotalAlloc,
+				SysBytes:        mem.Sys,
+				HeapInuseBytes:  mem.HeapInuse,
+				HeapIdleBytes:   mem.HeapIdle,
+				HeapObjects:     mem.HeapObjects,
+				StackInuseBytes: mem.StackInuse,
+				Mallocs:         mem.Mallocs,
+				Frees:           mem.Frees,
+				NumGC:           mem.NumGC,
+				GCPauseTotalMs:  durationMs(time.Duration(mem.PauseTotalNs)),
+			},
+			DB: dbPoolStats{
+				MaxOpenConns:      dbStats.MaxOpenConnections,
+				OpenConns:         dbStats.OpenConnections,
+				InUse:             dbStats.InUse,
+				Idle:              dbStats.Idle,
+				WaitCount:         dbStats.WaitCount,
+				WaitDurationMs:    durationMs(dbStats.WaitDuration),
+				MaxIdleClosed:     dbStats.MaxIdleClosed,
+				MaxIdleTimeClosed: dbStats.MaxIdleTimeClosed,
+				MaxLifetimeClosed: dbStats.MaxLifetimeClosed,
+			},
+			Upstream: upstreamPoolStats.snapshot(),
+		}
+		if mem.LastGC > 0 {
+			lastGC := time.Unix(0, int64(mem.LastGC))
+			stats.Memory.LastGC = &lastGC
+		}
+
+		writeAdminJSON(rw, http.StatusOK, stats)
+	})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/health"
+	"github.com/gocraft/web"
+)
+
+// IncidentsResponse represents the response from the incidents endpoint
+type IncidentsResponse struct {
+	Incidents []incident `json:"incidents"`
+}
+
+// WebhookDeliveriesResponse represents the response from the webhook
+// deliveries endpoint
+type WebhookDeliveriesResponse struct {
+	Deliveries []webhookDelivery `json:"deliveries"`
+
+	// NextBefore is the before parameter of the next page, or 0 if this is
+	// the last one
+	NextBefore int64 `json:"next_before"`
+}
+
+// Limits of the number of webhook deliveries listed at once
+const (
+	defaultWebhookDeliveriesLimit = 100
+	maxWebhookDeliveriesLimit     = 1000
+)
+
+// NodeDetailResponse represents the response from the node detail endpoint
+type NodeDetailResponse struct {
+	Node      *nodeState       `json:"node"`
+	DeepProbe *deepProbeResult `json:"deep_probe"`
+}
+
+// DeleteNodeResponse represents the response from the node delete endpoint
+type DeleteNodeResponse struct {
+	IP string `json:"ip"`
+
+	// Deleted is the number of rows deleted from each table
+	Deleted map[string]int64 `json:"deleted"`
+}
+
+// newListIncidentsHandler returns a handler that lists incidents. The kind
+// query parameter limits the result to one kind of incident and open=false
+// includes resolved incidents.
+func newListIncidentsHandler(db *sql.DB) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		query := req.URL.Query()
+		openOnly := query.Get("open") != "false"
+
+		incidents, err := listIncidents(db, query.Get("kind"), openOnly)
+		if err != nil {
+			c.err = err
+			c.job.EventErr("incidents.list", c.err)
+			return
+		}
+
+		writeJSON(c, rw, &IncidentsResponse{Incidents: incidents})
+	}
+}
+
+// newListWebhookDeliveriesHandler returns a handler that lists webhook
+// deliveries, newest first, limited to those with the status given in the
+// query if any. The limit and before query parameters page through them.
+func newListWebhookDeliveriesHandler(db *sql.DB) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		query := req.URL.Query()
+
+		limit := defaultWebhookDeliveriesLimit
+		if s := query.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > maxWebhookDeliveriesLimit {
+				writeJSONStatus(c, rw, http.StatusBadRequest, map[string]string{"error": "Invalid limit, expected 1 to " + strconv.Itoa(maxWebhookDeliveriesLimit)})
+				return
+			}
+			limit = n
+		}
+
+		var before int64
+		if s := query.Get("before"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 1 {
+				writeJSONStatus(c, rw, http.StatusBadRequest, map[string]string{"error": "Invalid before, expected a delivery id"})
+				return
+			}
+			before = n
+		}
+
+		deliveries, err := listWebhookDeliveries(db, query.Get("status"), before, limit)
+		if err != nil {
+			c.err = err
+			c.job.EventErr("webhooks.list", c.err)
+			return
+		}
+
+		resp := &WebhookDeliveriesResponse{Deliveries: deliveries}
+		if len(deliveries) == limit {
+			resp.NextBefore = deliveries[len(deliveries)-1].ID
+		}
+		writeJSON(c, rw, resp)
+	}
+}
+
+// newReplayWebhookDeliveryHandler returns a handler that queues a failed
+// webhook delivery to be attempted again
+func newReplayWebhookDeliveryHandler(db *sql.DB) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		id, err := strconv.ParseInt(req.PathParams["id"], 10, 64)
+		if err != nil {
+			writeJSONStatus(c, rw, http.StatusBadRequest, map[string]string{"error": "Invalid delivery id"})
+			return
+		}
+
+		err = replayWebhookDelivery(db, id)
+		if err == errWebhookDeliveryNotFound {
+			writeJSONStatus(c, rw, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		if err == errWebhookDeliveryNotFailed {
+			writeJSONStatus(c, rw, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.err = err
+			c.job.EventErr("webhooks.replay", c.err)
+			return
+		}
+
+		c.job.EventKv("webhooks.replayed", health.Kvs{"delivery": req.PathParams["id"]})
+		writeJSONStatus(c, rw, http.StatusAccepted, map[string]string{"status": webhookDeliveryPending})
+	}
+}
+
+// writeJSON writes v to the response as JSON
+func writeJSON(c *Context, rw web.ResponseWriter, v interface{}) {
+	writeJSONStatus(c, rw, http.StatusOK, v)
+}
+
+// writeJSONStatus writes v to the response as JSON with the given status code
+func writeJSONStatus(c *Context, rw web.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		c.err = err
+		c.job.EventErr("json.marshal", c.err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, err = rw.Write(body)
+	if err != nil {
+		c.err = err
+		c.job.EventErr("json.write_body", c.err)
+		return
+	}
+}
+
+// writeAdminJSON writes v to a response of the admin listener as JSON with
+// the given status code
+func writeAdminJSON(rw http.ResponseWriter, status int, v interface{}) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(b.Bytes())
+}
+
+// newNodeUptimeHandler returns a handler that reports the availability and
+// outages of a single node, weighting probe results by up to maxGap each
+func newNodeUptimeHandler(db *sql.DB, maxGap time.Duration) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		report, err := getNodeUptime(db, req.PathParams["ip"], maxGap)
+		if err != nil {
+			c.err = err
+			c.job.EventErr("uptime.node", c.err)
+			return
+		}
+
+		writeJSON(c, rw, report)
+	}
+}
+
+// newFleetUptimeHandler returns a handler that reports the availability of
+// every node and of the fleet as a whole, weighting probe results by up to
+// maxGap each
+func newFleetUptimeHandler(db *sql.DB, maxGap time.Duration) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		report, err := getFleetUptime(db, maxGap)
+		if err != nil {
+			c.err = err
+			c.job.EventErr("uptime.fleet", c.err)
+			return
+		}
+
+		writeJSON(c, rw, report)
+	}
+}
+
+// newNodeDetailHandler returns a handler that reports the current state and
+// latest deep probe of a single node
+func newNodeDetailHandler(db *sql.DB) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		ip := req.PathParams["ip"]
+		node, err := getCurrentNodeState(db, ip)
+		if err != nil {
+			c.err = err
+			c.job.EventErr("nodes.get", c.err)
+			return
+		}
+		if node == nil {
+			writeJSONStatus(c, rw, http.StatusNotFound, map[string]string{"error": "Node not found"})
+			return
+		}
+
+		deepProbe, err := getDeepProbeResult(db, ip)
+		if err != nil {
+			c.err = err
+			c.job.EventErr("nodes.get_deep_probe", c.err)
+			return
+		}
+
+		writeJSON(c, rw, &NodeDetailResponse{Node: node, DeepProbe: deepProbe})
+	}
+}
+
+// newDeleteNodeHandler returns a handler that deletes a node and everything
+// recorded about it
+func newDeleteNodeHandler(db *sql.DB) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		ip := req.PathParams["ip"]
+		deleted, err := deleteNode(db, ip)
+		if err != nil {
+			c.err = err
+			c.job.EventErr("nodes.delete", c.err)
+			return
+		}
+		if deleted == nil {
+			writeJSONStatus(c, rw, http.StatusNotFound, map[string]string{"error": "Node not found"})
+			return
+		}
+
+		c.job.EventKv("nodes.deleted", health.Kvs{"ip": ip})
+		writeJSON(c, rw, &DeleteNodeResponse{IP: ip, Deleted: deleted})
+	}
+}
+
+// newMetricsHandler returns a handler that serves metrics in the Prometheus
+// text exposition format
+func newMetricsHandler(sink *prometheusSink, db *sql.DB) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		var b bytes.Buffer
+		err := sink.WriteMetrics(&b, db)
+		if err != nil {
+			c.err = err
+			c.job.EventErr("metrics.write", c.err)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, err = rw.Write(b.Bytes())
+		if err != nil {
+			c.err = err
+			c.job.EventErr("metrics.write_body", c.err)
+			return
+		}
+	}
+}
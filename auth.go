@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/health"
+	"github.com/gocraft/web"
+)
+
+// apiKeyTableSchema is a SQL statement that creates the table of API keys.
+// Only a hash of each key's secret is stored.
+const apiKeyTableSchema = `CREATE TABLE IF NOT EXISTS api_keys (
+  id TEXT NOT NULL PRIMARY KEY,
+  name TEXT NOT NULL,
+  secret_hash TEXT NOT NULL,
+  scopes TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at DATETIME,
+  revoked_at DATETIME,
+  last_used_at DATETIME
+  );`
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognize
+const apiKeyPrefix = "cpk"
+
+// apiKeyHeader is an alternative to an Authorization: Bearer header
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyLastUsedResolution is how stale the recorded last use of a key may
+// get, so not every request writes to the database
+const apiKeyLastUsedResolution = time.Minute
+
+// Scopes granted to API keys. The admin scope grants every other scope.
+const (
+	scopeNodesRead   = "nodes:read"
+	scopeNodesWrite  = "nodes:write"
+	scopeMetricsRead = "metrics:read"
+	scopeAdmin       = "admin"
+)
+
+// apiScopes are the valid scopes
+var apiScopes = []string{scopeNodesRead, scopeNodesWrite, scopeMetricsRead, scopeAdmin}
+
+// routeScopes are the scopes required by routes, by method and route path.
+// Routes missing from it are denied to everyone, so a new route can't be
+// served without a scope by mistake.
+var routeScopes = map[string]string{
+	"GET /metrics":                         scopeMetricsRead,
+	"GET /incidents":                       scopeNodesRead,
+	"GET /nodes/:ip":                       scopeNodesRead,
+	"GET /nodes/:ip/uptime":                scopeNodesRead,
+	"GET /fleet/uptime":                    scopeNodesRead,
+	"DELETE /nodes/:ip":                    scopeNodesWrite,
+	"GET /webhooks/deliveries":             scopeAdmin,
+	"POST /webhooks/deliveries/:id/replay": scopeAdmin,
+	"GET /health":                          scopeAdmin,
+	"POST /config/reload":                  scopeAdmin,
+	"GET /debug/:*":                        scopeAdmin,
+	"POST /debug/:*":                       scopeAdmin,
+}
+
+// Authentication errors
+var (
+	errInvalidAPIKey     = errors.New("Invalid API key")
+	errAPIKeyRequired    = errors.New("An API key is required")
+	errInsufficientScope = errors.New("The API key doesn't have the required scope")
+	errRouteNotPermitted = errors.New("The route isn't permitted")
+)
+
+// parseScopes parses a comma separated list of scopes
+func parseScopes(s string) ([]string, error) {
+	scopes := []string{}
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		valid := false
+		for _, known := range apiScopes {
+			valid = valid || scope == known
+		}
+		if !valid {
+			return nil, fmt.Errorf("Unknown scope %q, expected one of %s", scope, strings.Join(apiScopes, ", "))
+		}
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes, nil
+}
+
+// parseAnonymousScopes parses the scopes granted to requests without an API
+// key, which may only read
+func parseAnonymousScopes(s string) ([]string, error) {
+	scopes, err := parseScopes(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range scopes {
+		if scope != scopeNodesRead {
+			return nil, fmt.Errorf("Scope %q can't be granted anonymously", scope)
+		}
+	}
+	return scopes, nil
+}
+
+// principal is who made a request
+type principal struct {
+	// KeyID and Name identify the API key used, and are empty for requests
+	// without one
+	KeyID  string
+	Name   string
+	Scopes []string
+}
+
+// anonymous reports whether the request was made without an API key
+func (p *principal) anonymous() bool {
+	return p.KeyID == ""
+}
+
+// hasScope reports whether the principal was granted scope
+func (p *principal) hasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKey is a stored API key, without its secret
+type apiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+
+	secretHash string
+}
+
+// active reports whether the key can be used at now
+func (k *apiKey) active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// hashAPIKeySecret returns the stored hash of a key's secret. Secrets are
+// random, so a fast hash can't be brute forced.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitAPIKey splits a key formatted as cpk_<id>_<secret>
+func splitAPIKey(key string) (string, string, bool) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// createAPIKey creates a key named name granting scopes, which expires after
+// ttl unless ttl is 0. It returns the key, which can't be recovered later.
+func createAPIKey(db *sql.DB, name string, scopes []string, ttl time.Duration) (string, *apiKey, error) {
+	random := make([]byte, 40)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(random[:8])
+	secret := hex.EncodeToString(random[8:])
+
+	key := &apiKey{ID: id, Name: name, Scopes: scopes, CreatedAt: time.Now().UTC()}
+	if ttl > 0 {
+		expiresAt := key.CreatedAt.Add(ttl)
+		key.ExpiresAt = &expiresAt
+	}
+
+	_, err = db.Exec(`INSERT INTO api_keys (id, name, secret_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?);`,
+		id, name, hashAPIKeySecret(secret), strings.Join(scopes, ","), key.CreatedAt, key.ExpiresAt)
+	if err != nil {
+		return "", nil, err
+	}
+	return apiKeyPrefix + "_" + id + "_" + secret, key, nil
+}
+
+// apiKeyColumns are the columns scanned by scanAPIKey
+const apiKeyColumns = `id, name, secret_hash, scopes, created_at, expires_at, revoked_at, last_used_at`
+
+// scanAPIKey scans a row of apiKeyColumns
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*apiKey, error) {
+	var k apiKey
+	var scopes string
+	err := row.Scan(&k.ID, &k.Name, &k.secretHash, &scopes, &k.CreatedAt, &k.ExpiresAt, &k.RevokedAt, &k.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	return &k, nil
+}
+
+// getAPIKey returns the key with the given id or nil if there's none
+func getAPIKey(db *sql.DB, id string) (*apiKey, error) {
+	k, err := scanAPIKey(db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?;`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+// listAPIKeys returns every key, oldest first
+func listAPIKeys(db *sql.DB) ([]*apiKey, error) {
+	rows, err := db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at, id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*apiKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// revokeAPIKey revokes the key with the given id and reports whether there
+// was an unrevoked key to revoke
+func revokeAPIKey(db *sql.DB, id string) (bool, error) {
+	res, err := db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL;`, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// authenticate returns the active key matching the presented key
+func authenticate(db *sql.DB, presented string, now time.Time) (*apiKey, error) {
+	id, secret, ok := splitAPIKey(presented)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	k, err := getAPIKey(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil || subtle.ConstantTimeCompare([]byte(k.secretHash), []byte(hashAPIKeySecret(secret))) != 1 || !k.active(now) {
+		return nil, errInvalidAPIKey
+	}
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > apiKeyLastUsedResolution {
+		_, err = db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?;`, now.UTC(), id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// presentedAPIKey returns the API key sent with r, if any
+func presentedAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.Header.Get(apiKeyHeader)
+}
+
+// newAuthMiddleware returns a middleware that authenticates the API key sent
+// with the request, attaches the principal to the context and enforces the
+// scope the route requires, denying routes missing from routeScopes.
+// Requests without a key are granted the live anonymous scopes. Every
+// authenticated request is audited. It has to run once the request is
+// routed.
+func newAuthMiddleware(db *sql.DB) middlewareFunc {
+	return func(c *Context, rw web.ResponseWriter, r *web.Request, next web.NextMiddlewareFunc) {
+		route := r.Method + " " + r.RoutePath()
+		c.principal = &principal{Scopes: currentSettings().anonymousScopes}
+
+		if presented := presentedAPIKey(r.Request); presented != "" {
+			k, err := authenticate(db, presented, time.Now())
+			if err == errInvalidAPIKey {
+				c.job.EventKv("auth.rejected", health.Kvs{"reason": "invalid_key", "route": route})
+				rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeJSONStatus(c, rw, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.err = err
+				c.job.EventErr("auth.authenticate", c.err)
+				return
+			}
+			c.principal = &principal{KeyID: k.ID, Name: k.Name, Scopes: k.Scopes}
+			c.job.KeyValue("api_key", k.ID)
+
+			// Audit the request, including when it's rejected below
+			defer func() {
+				c.job.EventKv("audit.request", health.Kvs{
+					"key_id":   c.principal.KeyID,
+					"key_name": c.principal.Name,
+					"route":    route,
+					"path":     r.URL.Path,
+					"status":   strconv.Itoa(rw.StatusCode()),
+				})
+			}()
+		}
+
+		scope, ok := routeScopes[route]
+		if !ok {
+			c.job.EventKv("auth.rejected", health.Kvs{"reason": "unlisted_route", "route": route})
+			writeJSONStatus(c, rw, http.StatusForbidden, map[string]string{"error": errRouteNotPermitted.Error()})
+			return
+		}
+		if !c.principal.hasScope(scope) {
+			if c.principal.anonymous() {
+				c.job.EventKv("auth.rejected", health.Kvs{"reason": "key_required", "route": route, "scope": scope})
+				rw.Header().Set("WWW-Authenticate", `Bearer scope="`+scope+`"`)
+				writeJSONStatus(c, rw, http.StatusUnauthorized, map[string]string{"error": errAPIKeyRequired.Error()})
+			} else {
+				c.job.EventKv("auth.rejected", health.Kvs{"reason": "insufficient_scope", "route": route, "scope": scope, "key_id": c.principal.KeyID})
+				rw.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				writeJSONStatus(c, rw, http.StatusForbidden, map[string]string{"error": errInsufficientScope.Error()})
+			}
+			return
+		}
+
+		next(rw, r)
+	}
+}
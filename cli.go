@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// Build metadata, set at build time with for example
+// -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// errCommandFailed is returned by commands that have already reported why
+// they failed
+var errCommandFailed = errors.New("Command failed")
+
+// usageError is an error in the arguments of a command
+type usageError struct {
+	error
+}
+
+// command is a subcommand of the CLI
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(w io.Writer, args []string) error
+}
+
+// commands are the subcommands of the CLI. Running without a command serves.
+var commands = []command{
+	{"serve", "", "Run the proxy", runServe},
+	{"probe", "<ip>", "Fetch the status of a node once and show where the time went", runProbe},
+	{"nodes list", "", "List the current state of every node", runNodesList},
+	{"nodes get", "<ip>", "Show the state, history and deep probe of a node", runNodesGet},
+	{"nodes delete", "<ip>", "Delete a node and its history", runNodesDelete},
+	{"db migrate", "", "Create missing tables and indexes", runDBMigrate},
+	{"db vacuum", "", "Rebuild the database to reclaim free space", runDBVacuum},
+	{"db check", "", "Check the integrity of the database", runDBCheck},
+	{"keys create", "", "Create an API key and print it once", runKeysCreate},
+	{"keys list", "", "List API keys", runKeysList},
+	{"keys revoke", "<id>", "Revoke an API key", runKeysRevoke},
+	{"config print", "", "Print the effective config with secrets redacted", runConfigPrint},
+	{"version", "", "Print the version and build metadata", runVersion},
+}
+
+// runCLI runs the command named by the leading args, or serves if there's
+// none
+func runCLI(w io.Writer, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(w, args)
+	}
+	if args[0] == "help" {
+		printUsage(w)
+		return nil
+	}
+
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != cmd.name {
+			continue
+		}
+		return cmd.run(w, args[len(words):])
+	}
+
+	printUsage(os.Stderr)
+	return usageError{fmt.Errorf("Unknown command: %s", strings.Join(args, " "))}
+}
+
+// printUsage lists the commands
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: corsproxyd <command> [flags] [args]")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command accepts the config flags, see corsproxyd <command> -h.")
+	fmt.Fprintln(w, "Commands other than serve print JSON with -json.")
+}
+
+// commandFlags parses the flags of the command name, which takes the space
+// separated positional arguments params. The returned bool is whether to
+// print JSON.
+func commandFlags(name string, args []string, params string, extra func(fs *flag.FlagSet)) (*Config, []string, bool, error) {
+	fs := flag.NewFlagSet("corsproxyd "+name, flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "Print JSON")
+	if extra != nil {
+		extra(fs)
+	}
+
+	cfg, err := loadConfigFlags(fs, args)
+	if err == flag.ErrHelp {
+		return nil, nil, false, err
+	}
+	if err != nil {
+		return nil, nil, false, usageError{err}
+	}
+	if fs.NArg() != len(strings.Fields(params)) {
+		return nil, nil, false, usageError{fmt.Errorf("Usage: corsproxyd %s [flags] %s", name, params)}
+	}
+	return cfg, fs.Args(), *jsonOut, nil
+}
+
+// writeOutput writes v as JSON or, unless jsonOut is set, as text
+func writeOutput(w io.Writer, jsonOut bool, v interface{}, text func(tw *tabwriter.Writer)) error {
+	if jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	text(tw)
+	return tw.Flush()
+}
+
+// openExistingDB opens the database in file, failing rather than creating it
+// if it doesn't exist
+func openExistingDB(file string) (*sql.DB, error) {
+	_, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	return openDB(file)
+}
+
+func runServe(w io.Writer, args []string) error {
+	cfg, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		return err
+	}
+	if err != nil {
+		return usageError{err}
+	}
+	serve(cfg, args)
+	return nil
+}
+
+func runConfigPrint(w io.Writer, args []string) error {
+	err := printConfig(w, args)
+	if err != nil && err != flag.ErrHelp {
+		return usageError{err}
+	}
+	return err
+}
+
+// probeReport is the outcome of a one-off probe
+type probeReport struct {
+	IP     string       `json:"ip"`
+	State  string       `json:"state,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Timing *probeTiming `json:"timing,omitempty"`
+}
+
+// probeTiming is the time spent on each phase of a probe in milliseconds
+type probeTiming struct {
+	DNSMs     float64 `json:"dns_ms"`
+	ConnectMs float64 `json:"connect_ms"`
+	TLSMs     float64 `json:"tls_ms"`
+	TTFBMs    float64 `json:"ttfb_ms"`
+	TotalMs   float64 `json:"total_ms"`
+	Reused    bool    `json:"reused"`
+}
+
+func runProbe(w io.Writer, args []string) error {
+	cfg, rest, jsonOut, err := commandFlags("probe", args, "<ip>", nil)
+	if err != nil {
+		return err
+	}
+	ip := rest[0]
+
+	s, err := newLiveSettings(cfg)
+	if err != nil {
+		return err
+	}
+	settings.Store(s)
+	if !s.allowTarget(ip) {
+		return errTargetNotAllowed
+	}
+	HTTPClient.Transport = newUpstreamTransport(cfg.Upstream, upstreamPoolStats)
+	stream = health.NewStream()
+
+	report := &probeReport{IP: ip}
+	_, status, timing, err := fetchNodeStatus(context.Background(), stream.NewJob("probe"), ip)
+	if err != nil {
+		report.Error = err.Error()
+	} else {
+		report.State = status.Status
+	}
+	if timing != nil {
+		report.Timing = &probeTiming{
+			DNSMs:     durationMs(timing.DNS),
+			ConnectMs: durationMs(timing.Connect),
+			TLSMs:     durationMs(timing.TLS),
+			TTFBMs:    durationMs(timing.TTFB),
+			TotalMs:   durationMs(timing.Total),
+			Reused:    timing.Reused,
+		}
+	}
+
+	err = writeOutput(w, jsonOut, report, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "ip\t%s\n", report.IP)
+		if report.Error != "" {
+			fmt.Fprintf(tw, "error\t%s\n", report.Error)
+		} else {
+			fmt.Fprintf(tw, "state\t%s\n", report.State)
+		}
+		if t := report.Timing; t != nil {
+			fmt.Fprintf(tw, "dns\t%.1fms\n", t.DNSMs)
+			fmt.Fprintf(tw, "connect\t%.1fms\n", t.ConnectMs)
+			fmt.Fprintf(tw, "tls\t%.1fms\n", t.TLSMs)
+			fmt.Fprintf(tw, "ttfb\t%.1fms\n", t.TTFBMs)
+			fmt.Fprintf(tw, "total\t%.1fms\n", t.TotalMs)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if report.Error != "" {
+		return errCommandFailed
+	}
+	return nil
+}
+
+func runNodesList(w io.Writer, args []string) error {
+	var state string
+	cfg, _, jsonOut, err := commandFlags("nodes list", args, "", func(fs *flag.FlagSet) {
+		fs.StringVar(&state, "state", "", "Only list nodes in this state")
+	})
+	if err != nil {
+		return err
+	}
+	db, err := openExistingDB(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	nodes, err := listCurrentNodeStates(db)
+	if err != nil {
+		return err
+	}
+	if state != "" {
+		filtered := []nodeState{}
+		for _, n := range nodes {
+			if n.State == state {
+				filtered = append(filtered, n)
+			}
+		}
+		nodes = filtered
+	}
+
+	return writeOutput(w, jsonOut, nodes, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "IP\tSTATE\tSINCE")
+		for _, n := range nodes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", n.IP, n.State, n.EnteredAt.Format(time.RFC3339))
+		}
+	})
+}
+
+// nodeReport is everything recorded about a node
+type nodeReport struct {
+	Node      *nodeState        `json:"node"`
+	History   []nodeStateChange `json:"history"`
+	DeepProbe *deepProbeResult  `json:"deep_probe"`
+}
+
+func runNodesGet(w io.Writer, args []string) error {
+	var limit int
+	cfg, rest, jsonOut, err := commandFlags("nodes get", args, "<ip>", func(fs *flag.FlagSet) {
+		fs.IntVar(&limit, "history", 20, "Number of state transitions to show")
+	})
+	if err != nil {
+		return err
+	}
+	db, err := openExistingDB(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ip := rest[0]
+	node, err := getCurrentNodeState(db, ip)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return errors.New("Node not found: " + ip)
+	}
+	report := &nodeReport{Node: node}
+	report.History, err = listNodeStateHistory(db, ip, limit)
+	if err != nil {
+		return err
+	}
+	report.DeepProbe, err = getDeepProbeResult(db, ip)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(w, jsonOut, report, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "ip\t%s\n", node.IP)
+		fmt.Fprintf(tw, "state\t%s\n", node.State)
+		fmt.Fprintf(tw, "since\t%s\n", node.EnteredAt.Format(time.RFC3339))
+		fmt.Fprintf(tw, "updated\t%s\n", node.UpdatedAt.Format(time.RFC3339))
+		if report.DeepProbe != nil {
+			fmt.Fprintf(tw, "deep probe\t%s\n", report.DeepProbe.ProbedAt.Format(time.RFC3339))
+		}
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "CHANGED\tFROM\tTO")
+		for _, c := range report.History {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", c.ChangedAt.Format(time.RFC3339), c.From, c.To)
+		}
+	})
+}
+
+func runNodesDelete(w io.Writer, args []string) error {
+	cfg, rest, jsonOut, err := commandFlags("nodes delete", args, "<ip>", nil)
+	if err != nil {
+		return err
+	}
+	db, err := openExistingDB(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ip := rest[0]
+	deleted, err := deleteNode(db, ip)
+	if err != nil {
+		return err
+	}
+	if deleted == nil {
+		return errors.New("Node not found: " + ip)
+	}
+	var total int64
+	for _, n := range deleted {
+		total += n
+	}
+
+	return writeOutput(w, jsonOut, &DeleteNodeResponse{IP: ip, Deleted: deleted}, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Deleted %s, %d rows:\n", ip, total)
+		for _, table := range nodeTables {
+			fmt.Fprintf(tw, "  %s\t%d\n", table, deleted[table])
+		}
+	})
+}
+
+// listTables returns the names of the tables in the database
+func listTables(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+func runDBMigrate(w io.Writer, args []string) error {
+	cfg, _, jsonOut, err := commandFlags("db migrate", args, "", nil)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tables, err := listTables(db)
+	if err != nil {
+		return err
+	}
+	return writeOutput(w, jsonOut, map[string]interface{}{"file": cfg.DB.File, "tables": tables}, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Migrated %s, tables: %s\n", cfg.DB.File, strings.Join(tables, ", "))
+	})
+}
+
+func runDBVacuum(w io.Writer, args []string) error {
+	cfg, _, jsonOut, err := commandFlags("db vacuum", args, "", nil)
+	if err != nil {
+		return err
+	}
+	db, err := openExistingDB(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	before, err := os.Stat(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`VACUUM;`)
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+
+	result := map[string]interface{}{"file": cfg.DB.File, "size_before": before.Size(), "size_after": after.Size()}
+	return writeOutput(w, jsonOut, result, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Vacuumed %s from %d to %d bytes\n", cfg.DB.File, before.Size(), after.Size())
+	})
+}
+
+// dbCheckReport is the outcome of a database integrity check
+type dbCheckReport struct {
+	File     string   `json:"file"`
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems"`
+}
+
+func runDBCheck(w io.Writer, args []string) error {
+	cfg, _, jsonOut, err := commandFlags("db check", args, "", nil)
+	if err != nil {
+		return err
+	}
+
+	// Check the database as it is, without creating missing tables
+	_, err = os.Stat(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report := &dbCheckReport{File: cfg.DB.File, Problems: []string{}}
+	rows, err := db.Query(`PRAGMA integrity_check;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var result string
+		err = rows.Scan(&result)
+		if err != nil {
+			return err
+		}
+		if result != "ok" {
+			report.Problems = append(report.Problems, result)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	tables, err := listTables(db)
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for _, table := range tables {
+		existing[table] = true
+	}
+	for _, table := range append(nodeTables, "webhook_deliveries", "api_keys") {
+		if !existing[table] {
+			report.Problems = append(report.Problems, "Missing table "+table+", run db migrate")
+		}
+	}
+	report.OK = len(report.Problems) == 0
+
+	err = writeOutput(w, jsonOut, report, func(tw *tabwriter.Writer) {
+		if report.OK {
+			fmt.Fprintf(tw, "%s is ok\n", report.File)
+		}
+		for _, p := range report.Problems {
+			fmt.Fprintln(tw, p)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !report.OK {
+		return errCommandFailed
+	}
+	return nil
+}
+
+// createdKeyReport is the outcome of keys create. Key is only shown once.
+type createdKeyReport struct {
+	*apiKey
+	Key string `json:"key"`
+}
+
+func runKeysCreate(w io.Writer, args []string) error {
+	var name, scopeList string
+	var expires time.Duration
+	cfg, _, jsonOut, err := commandFlags("keys create", args, "", func(fs *flag.FlagSet) {
+		fs.StringVar(&name, "name", "", "Name of the key, such as who it's for")
+		fs.StringVar(&scopeList, "scopes", scopeNodesRead, "Comma separated scopes: "+strings.Join(apiScopes, ", "))
+		fs.DurationVar(&expires, "expires", 0, "Expire the key after this long, or never if 0")
+	})
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return usageError{errors.New("-name is required")}
+	}
+	if expires < 0 {
+		return usageError{errors.New("-expires must not be negative")}
+	}
+	scopes, err := parseScopes(scopeList)
+	if err != nil {
+		return usageError{err}
+	}
+	if len(scopes) == 0 {
+		return usageError{errors.New("-scopes must not be empty")}
+	}
+
+	db, err := openExistingDB(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	key, k, err := createAPIKey(db, name, scopes, expires)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(w, jsonOut, &createdKeyReport{apiKey: k, Key: key}, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Created key %s (%s) with scopes %s\n", k.ID, k.Name, strings.Join(k.Scopes, ","))
+		if k.ExpiresAt != nil {
+			fmt.Fprintf(tw, "Expires at %s\n", k.ExpiresAt.Format(time.RFC3339))
+		}
+		fmt.Fprintf(tw, "\n%s\n\nStore the key now, it can't be shown again.\n", key)
+	})
+}
+
+func runKeysList(w io.Writer, args []string) error {
+	cfg, _, jsonOut, err := commandFlags("keys list", args, "", nil)
+	if err != nil {
+		return err
+	}
+	db, err := openExistingDB(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	keys, err := listAPIKeys(db)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return writeOutput(w, jsonOut, keys, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tSTATUS\tCREATED\tEXPIRES\tLAST USED")
+		for _, k := range keys {
+			status := "active"
+			if k.RevokedAt != nil {
+				status = "revoked"
+			} else if !k.active(now) {
+				status = "expired"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, strings.Join(k.Scopes, ","), status,
+				k.CreatedAt.Format(time.RFC3339), formatOptionalTime(k.ExpiresAt), formatOptionalTime(k.LastUsedAt))
+		}
+	})
+}
+
+func runKeysRevoke(w io.Writer, args []string) error {
+	cfg, rest, jsonOut, err := commandFlags("keys revoke", args, "<id>", nil)
+	if err != nil {
+		return err
+	}
+	db, err := openExistingDB(cfg.DB.File)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id := rest[0]
+	revoked, err := revokeAPIKey(db, id)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return errors.New("Key not found or already revoked: " + id)
+	}
+
+	return writeOutput(w, jsonOut, map[string]string{"id": id, "status": "revoked"}, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Revoked key %s\n", id)
+	})
+}
+
+// formatOptionalTime formats t as RFC 3339, or - if it's nil
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// versionInfo is the version and build metadata of the binary
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// buildVersion returns the version and build metadata, falling back to the
+// VCS information recorded by the go tool if it wasn't set at build time
+func buildVersion() *versionInfo {
+	v := &versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && v.Commit == "":
+			v.Commit = s.Value
+		case s.Key == "vcs.time" && v.BuildDate == "":
+			v.BuildDate = s.Value
+		}
+	}
+	return v
+}
+
+func runVersion(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("corsproxyd version", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "Print JSON")
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return err
+	}
+	if err != nil || fs.NArg() > 0 {
+		return usageError{errors.New("Usage: corsproxyd version [-json]")}
+	}
+
+	v := buildVersion()
+	return writeOutput(w, *jsonOut, v, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "corsproxyd %s", v.Version)
+		if v.Commit != "" {
+			fmt.Fprintf(tw, " (%s)", v.Commit)
+		}
+		fmt.Fprintf(tw, "\n")
+		if v.BuildDate != "" {
+			fmt.Fprintf(tw, "built\t%s\n", v.BuildDate)
+		}
+		fmt.Fprintf(tw, "go\t%s %s\n", v.GoVersion, v.Platform)
+	})
+}
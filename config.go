@@ -0,0 +1,973 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFileEnv names the config file if the -config flag isn't given
+const configFileEnv = "CORS_PROXY_CONFIG_FILE"
+
+// redacted replaces secrets when printing the config
+const redacted = "[REDACTED]"
+
+// Config is the configuration of the proxy. Each setting is read, from lowest
+// to highest precedence, from its default, the JSON or YAML config file, the
+// environment variable in its env tag and the flag named after its JSON path.
+// Settings tagged reload take effect on reload, the others on restart.
+type Config struct {
+	Server       ServerConfig      `json:"server"`
+	CORS         CORSConfig        `json:"cors"`
+	Targets      TargetsConfig     `json:"targets"`
+	TargetTokens TargetTokenConfig `json:"target_tokens"`
+	RateLimit    RateLimitConfig   `json:"rate_limit"`
+	Outbound     OutboundConfig    `json:"outbound"`
+	Auth         AuthConfig        `json:"auth"`
+	TLS          TLSConfig         `json:"tls"`
+	Admin        AdminConfig       `json:"admin"`
+	DB           DBConfig          `json:"db"`
+	Upstream     UpstreamConfig    `json:"upstream"`
+	Sinks        SinksConfig       `json:"sinks"`
+	Webhooks     WebhooksConfig    `json:"webhooks"`
+	Poller       PollerConfig      `json:"poller"`
+	Uptime       UptimeConfig      `json:"uptime"`
+	DeepProbe    DeepProbeConfig   `json:"deep_probe"`
+	Stuck        StuckConfig       `json:"stuck"`
+	Trace        TraceConfig       `json:"trace"`
+	Readiness    ReadinessConfig   `json:"readiness"`
+	Shutdown     ShutdownConfig    `json:"shutdown"`
+}
+
+// ServerConfig configures the public listener
+type ServerConfig struct {
+	Host         string `json:"host" env:"CORS_PROXY_HOST"`
+	Port         string `json:"port" env:"CORS_PROXY_PORT"`
+	ServerTiming bool   `json:"server_timing" env:"CORS_PROXY_SERVER_TIMING"`
+
+	// Socket, if set, is the path of a Unix domain socket to listen on
+	// instead of host:port, created with the octal permissions SocketMode.
+	// Both are ignored if a public socket is passed by socket activation.
+	Socket     string `json:"socket" env:"CORS_PROXY_SOCKET"`
+	SocketMode string `json:"socket_mode" env:"CORS_PROXY_SOCKET_MODE"`
+
+	// ReadHeaderTimeout, ReadTimeout and WriteTimeout bound reading a
+	// request and writing its response, IdleTimeout how long a keep-alive
+	// connection waits for the next request. Zero means no limit.
+	ReadHeaderTimeout Duration `json:"read_header_timeout" env:"CORS_PROXY_SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       Duration `json:"read_timeout" env:"CORS_PROXY_SERVER_READ_TIMEOUT"`
+	WriteTimeout      Duration `json:"write_timeout" env:"CORS_PROXY_SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       Duration `json:"idle_timeout" env:"CORS_PROXY_SERVER_IDLE_TIMEOUT"`
+	MaxHeaderBytes    int      `json:"max_header_bytes" env:"CORS_PROXY_SERVER_MAX_HEADER_BYTES"`
+}
+
+// CORSConfig configures CORS responses
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to read responses, or * for any
+	AllowedOrigins stringList `json:"allowed_origins" env:"CORS_PROXY_CORS_ORIGINS" reload:"true"`
+}
+
+// TargetsConfig limits the nodes requests are made to. Each entry is an ip or
+// a CIDR. Deny takes precedence and an empty allow list allows any target.
+type TargetsConfig struct {
+	Allow stringList `json:"allow" env:"CORS_PROXY_TARGETS_ALLOW" reload:"true"`
+	Deny  stringList `json:"deny" env:"CORS_PROXY_TARGETS_DENY" reload:"true"`
+}
+
+// TargetTokenConfig configures the signed tokens permitting browsers to query
+// a target, issued by the backend as JWTs signed with HS256 by HMACKey or with
+// EdDSA by the private key of Ed25519PublicKey, which is base64 encoded.
+// Mode is off, log-only or enforce.
+type TargetTokenConfig struct {
+	Mode             string   `json:"mode" env:"CORS_PROXY_TARGET_TOKEN_MODE" reload:"true"`
+	HMACKey          string   `json:"hmac_key" env:"CORS_PROXY_TARGET_TOKEN_HMAC_KEY" secret:"true" reload:"true"`
+	Ed25519PublicKey string   `json:"ed25519_public_key" env:"CORS_PROXY_TARGET_TOKEN_ED25519_PUBLIC_KEY" reload:"true"`
+	Leeway           Duration `json:"leeway" env:"CORS_PROXY_TARGET_TOKEN_LEEWAY" reload:"true"`
+}
+
+// TLSConfig configures HTTPS on the public listener. It's disabled unless a
+// certificate is set.
+type TLSConfig struct {
+	CertFile       string     `json:"cert_file" env:"CORS_PROXY_TLS_CERT_FILE"`
+	KeyFile        string     `json:"key_file" env:"CORS_PROXY_TLS_KEY_FILE"`
+	MinVersion     string     `json:"min_version" env:"CORS_PROXY_TLS_MIN_VERSION"`
+	CipherSuites   stringList `json:"cipher_suites" env:"CORS_PROXY_TLS_CIPHER_SUITES"`
+	ReloadInterval Duration   `json:"reload_interval" env:"CORS_PROXY_TLS_RELOAD_INTERVAL"`
+	RedirectAddr   string     `json:"redirect_addr" env:"CORS_PROXY_HTTP_REDIRECT_ADDR"`
+}
+
+// Enabled reports whether HTTPS is configured
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// AdminConfig configures the admin listener. The dashboard is only served if
+// a password is set.
+type AdminConfig struct {
+	Addr            string `json:"addr" env:"CORS_PROXY_ADMIN_ADDR"`
+	User            string `json:"user" env:"CORS_PROXY_ADMIN_USER"`
+	Password        string `json:"password" env:"CORS_PROXY_ADMIN_PASSWORD" secret:"true"`
+	DashboardErrors int    `json:"dashboard_errors" env:"CORS_PROXY_DASHBOARD_ERRORS"`
+}
+
+// RateLimitConfig configures the per client rate limits of incoming requests
+type RateLimitConfig struct {
+	// Routes maps route paths such as /status/:ip, or * for every other
+	// route, to their limit. Routes without a limit aren't limited.
+	Routes rateLimits `json:"routes" env:"CORS_PROXY_RATE_LIMITS" reload:"true"`
+
+	// TrustedProxies are the ips and CIDRs of the proxies whose Forwarded
+	// and X-Forwarded-For headers identify the client
+	TrustedProxies stringList `json:"trusted_proxies" env:"CORS_PROXY_TRUSTED_PROXIES" reload:"true"`
+
+	// MaxClients bounds the buckets held in memory, and buckets idle for
+	// IdleTimeout are dropped
+	MaxClients  int      `json:"max_clients" env:"CORS_PROXY_RATE_LIMIT_MAX_CLIENTS"`
+	IdleTimeout Duration `json:"idle_timeout" env:"CORS_PROXY_RATE_LIMIT_IDLE_TIMEOUT"`
+}
+
+// OutboundConfig limits the requests made to relays, by clients and the
+// poller alike. Client requests over a limit are answered with the last known
+// state and throttled polls are deferred.
+type OutboundConfig struct {
+	// PerTarget limits the requests to each relay and Global those to all
+	// relays together, as requests/per:burst. Empty limits don't apply.
+	PerTarget rateLimit `json:"per_target" env:"CORS_PROXY_OUTBOUND_PER_TARGET" reload:"true"`
+	Global    rateLimit `json:"global" env:"CORS_PROXY_OUTBOUND_GLOBAL" reload:"true"`
+
+	// MaxTargets bounds the per target buckets held in memory
+	MaxTargets int `json:"max_targets" env:"CORS_PROXY_OUTBOUND_MAX_TARGETS"`
+}
+
+// AuthConfig configures the API key authentication of the management API
+type AuthConfig struct {
+	// AnonymousScopes are granted to requests without an API key. Only
+	// nodes:read may be granted, and none is by default.
+	AnonymousScopes stringList `json:"anonymous_scopes" env:"CORS_PROXY_AUTH_ANONYMOUS_SCOPES" reload:"true"`
+}
+
+// DBConfig configures the sqlite database
+type DBConfig struct {
+	File string `json:"file" env:"CORS_PROXY_DB_FILE"`
+}
+
+// UpstreamConfig configures requests to relays
+type UpstreamConfig struct {
+	Timeout Duration `json:"timeout" env:"CORS_PROXY_UPSTREAM_TIMEOUT" reload:"true"`
+
+	DialTimeout           Duration `json:"dial_timeout" env:"CORS_PROXY_UPSTREAM_DIAL_TIMEOUT"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout" env:"CORS_PROXY_UPSTREAM_TLS_HANDSHAKE_TIMEOUT"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout" env:"CORS_PROXY_UPSTREAM_RESPONSE_HEADER_TIMEOUT"`
+	KeepAlive             Duration `json:"keep_alive" env:"CORS_PROXY_UPSTREAM_KEEP_ALIVE"`
+
+	// MaxIdleConns limits the idle connections kept in total and
+	// MaxIdleConnsPerHost those kept per relay. MaxConnsPerHost, if not
+	// zero, limits the connections per relay.
+	MaxIdleConns        int      `json:"max_idle_conns" env:"CORS_PROXY_UPSTREAM_MAX_IDLE_CONNS"`
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host" env:"CORS_PROXY_UPSTREAM_MAX_IDLE_CONNS_PER_HOST"`
+	MaxConnsPerHost     int      `json:"max_conns_per_host" env:"CORS_PROXY_UPSTREAM_MAX_CONNS_PER_HOST"`
+	IdleConnTimeout     Duration `json:"idle_conn_timeout" env:"CORS_PROXY_UPSTREAM_IDLE_CONN_TIMEOUT"`
+
+	// PoolStatsInterval is how often pool statistics are emitted as gauges,
+	// or 0 to not emit them
+	PoolStatsInterval Duration `json:"pool_stats_interval" env:"CORS_PROXY_UPSTREAM_POOL_STATS_INTERVAL"`
+}
+
+// SinksConfig configures the health sinks
+type SinksConfig struct {
+	Names          stringList        `json:"names" env:"CORS_PROXY_SINKS"`
+	BufferSize     int               `json:"buffer_size" env:"CORS_PROXY_SINK_BUFFER"`
+	WriterFile     string            `json:"writer_file" env:"CORS_PROXY_WRITER_FILE"`
+	JSONWriterFile string            `json:"json_writer_file" env:"CORS_PROXY_JSON_WRITER_FILE"`
+	StatsD         StatsDConfig      `json:"statsd"`
+	JSONPolling    JSONPollingConfig `json:"json_polling"`
+}
+
+// StatsDConfig configures the statsd sink
+type StatsDConfig struct {
+	Addr               string `json:"addr" env:"CORS_PROXY_STATSD_ADDR"`
+	Prefix             string `json:"prefix" env:"CORS_PROXY_STATSD_PREFIX"`
+	SkipNestedEvents   bool   `json:"skip_nested_events" env:"CORS_PROXY_STATSD_SKIP_NESTED_EVENTS"`
+	SkipTopLevelEvents bool   `json:"skip_top_level_events" env:"CORS_PROXY_STATSD_SKIP_TOP_LEVEL_EVENTS"`
+}
+
+// JSONPollingConfig configures the JSON polling sink
+type JSONPollingConfig struct {
+	Interval Duration `json:"interval" env:"CORS_PROXY_JSON_POLLING_INTERVAL"`
+	Retain   Duration `json:"retain" env:"CORS_PROXY_JSON_POLLING_RETAIN"`
+}
+
+// WebhooksConfig configures webhook deliveries
+type WebhooksConfig struct {
+	Subscriptions webhookSubscriptions `json:"subscriptions" env:"CORS_PROXY_WEBHOOKS" reload:"true"`
+	Interval      Duration             `json:"interval" env:"CORS_PROXY_WEBHOOK_INTERVAL"`
+	MaxAttempts   int                  `json:"max_attempts" env:"CORS_PROXY_WEBHOOK_MAX_ATTEMPTS"`
+	Backoff       Duration             `json:"backoff" env:"CORS_PROXY_WEBHOOK_BACKOFF"`
+}
+
+// PollerConfig configures background polling of nodes. An interval of 0
+// disables polling.
+type PollerConfig struct {
+	Interval    Duration `json:"interval" env:"CORS_PROXY_POLL_INTERVAL"`
+	Jitter      Duration `json:"jitter" env:"CORS_PROXY_POLL_JITTER"`
+	MaxBackoff  Duration `json:"max_backoff" env:"CORS_PROXY_POLL_MAX_BACKOFF"`
+	Concurrency int      `json:"concurrency" env:"CORS_PROXY_POLL_CONCURRENCY"`
+}
+
+// UptimeConfig configures availability reports and the retention of the
+// probe results they're computed from
+type UptimeConfig struct {
+	// MaxSampleGap caps the time a probe result stands for in availability
+	// reports. Zero means the poller's max backoff, the longest a failing
+	// node goes unprobed, or its default if the poller is disabled.
+	MaxSampleGap Duration `json:"max_sample_gap" env:"CORS_PROXY_UPTIME_MAX_SAMPLE_GAP"`
+
+	// PruneInterval is how often probe results older than the longest
+	// report window are deleted
+	PruneInterval Duration `json:"prune_interval" env:"CORS_PROXY_UPTIME_PRUNE_INTERVAL"`
+}
+
+// SampleGap returns the cap on the time a probe result stands for
+func (c *Config) SampleGap() time.Duration {
+	switch {
+	case c.Uptime.MaxSampleGap > 0:
+		return time.Duration(c.Uptime.MaxSampleGap)
+	case c.Poller.Interval > 0:
+		return time.Duration(c.Poller.MaxBackoff)
+	}
+	return time.Duration(defaultConfig().Poller.MaxBackoff)
+}
+
+// DeepProbeConfig configures extended probes made by the poller
+type DeepProbeConfig struct {
+	Enabled           bool     `json:"enabled" env:"CORS_PROXY_DEEP_PROBE"`
+	Ports             portList `json:"ports" env:"CORS_PROXY_DEEP_PROBE_PORTS"`
+	CertExpiryWarning Duration `json:"cert_expiry_warning" env:"CORS_PROXY_CERT_EXPIRY_WARNING"`
+}
+
+// StuckConfig configures the stuck node detector. It's disabled if there are
+// no thresholds.
+type StuckConfig struct {
+	CheckInterval Duration        `json:"check_interval" env:"CORS_PROXY_STUCK_CHECK_INTERVAL"`
+	Thresholds    stateThresholds `json:"thresholds" env:"CORS_PROXY_STUCK_THRESHOLDS"`
+}
+
+// TraceConfig configures span export. It's disabled unless a target is set.
+type TraceConfig struct {
+	Export         string   `json:"export" env:"CORS_PROXY_TRACE_EXPORT"`
+	ExportInterval Duration `json:"export_interval" env:"CORS_PROXY_TRACE_EXPORT_INTERVAL"`
+	SampleRatio    float64  `json:"sample_ratio" env:"CORS_PROXY_TRACE_SAMPLE_RATIO"`
+}
+
+// ReadinessConfig configures the readiness checks
+type ReadinessConfig struct {
+	Timeout      Duration `json:"timeout" env:"CORS_PROXY_READY_TIMEOUT"`
+	MaxWriteWait Duration `json:"max_write_wait" env:"CORS_PROXY_READY_MAX_WRITE_WAIT"`
+
+	// SampleInterval is how often the write queue and sinks are sampled.
+	// Checks report the latest sample.
+	SampleInterval Duration `json:"sample_interval" env:"CORS_PROXY_READY_SAMPLE_INTERVAL"`
+}
+
+// ShutdownConfig configures graceful shutdown
+type ShutdownConfig struct {
+	DrainDelay Duration `json:"drain_delay" env:"CORS_PROXY_SHUTDOWN_DRAIN_DELAY"`
+	Timeout    Duration `json:"timeout" env:"CORS_PROXY_SHUTDOWN_TIMEOUT"`
+}
+
+// defaultConfig returns the config used for settings that aren't set anywhere
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Host:              "127.0.0.1",
+			Port:              "8080",
+			SocketMode:        "0660",
+			ReadHeaderTimeout: Duration(5 * time.Second),
+			ReadTimeout:       Duration(30 * time.Second),
+			WriteTimeout:      Duration(30 * time.Second),
+			IdleTimeout:       Duration(2 * time.Minute),
+			MaxHeaderBytes:    1 << 20,
+		},
+		CORS: CORSConfig{AllowedOrigins: stringList{accessControlAllowOriginHeader}},
+		Targets: TargetsConfig{
+			Allow: stringList{},
+			Deny:  stringList{},
+		},
+		TargetTokens: TargetTokenConfig{Mode: targetTokenOff, Leeway: Duration(30 * time.Second)},
+		RateLimit: RateLimitConfig{
+			Routes:         rateLimits{statusRoutePath: {Requests: 10, Per: Duration(time.Second), Burst: 20}},
+			TrustedProxies: stringList{"127.0.0.0/8", "::1"},
+			MaxClients:     100000,
+			IdleTimeout:    Duration(10 * time.Minute),
+		},
+		Outbound: OutboundConfig{
+			PerTarget:  rateLimit{Requests: 2, Per: Duration(time.Second), Burst: 5},
+			Global:     rateLimit{Requests: 200, Per: Duration(time.Second), Burst: 400},
+			MaxTargets: 100000,
+		},
+		Auth:  AuthConfig{AnonymousScopes: stringList{}},
+		TLS:   TLSConfig{MinVersion: "1.2", ReloadInterval: Duration(10 * time.Second)},
+		Admin: AdminConfig{Addr: "127.0.0.1:5020", User: "admin", DashboardErrors: 200},
+		DB:    DBConfig{File: "/opt/corsproxy.db"},
+		Upstream: UpstreamConfig{
+			Timeout:               Duration(15 * time.Second),
+			DialTimeout:           Duration(5 * time.Second),
+			TLSHandshakeTimeout:   Duration(5 * time.Second),
+			ResponseHeaderTimeout: Duration(10 * time.Second),
+			KeepAlive:             Duration(30 * time.Second),
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       Duration(90 * time.Second),
+			PoolStatsInterval:     Duration(10 * time.Second),
+		},
+		Sinks: SinksConfig{
+			Names:       stringList{sinkWriter},
+			BufferSize:  4096,
+			StatsD:      StatsDConfig{Prefix: "corsproxy"},
+			JSONPolling: JSONPollingConfig{Interval: Duration(time.Minute), Retain: Duration(5 * time.Minute)},
+		},
+		Webhooks: WebhooksConfig{
+			Subscriptions: webhookSubscriptions{},
+			Interval:      Duration(5 * time.Second),
+			MaxAttempts:   8,
+			Backoff:       Duration(10 * time.Second),
+		},
+		Poller: PollerConfig{
+			Interval:    Duration(5 * time.Minute),
+			Jitter:      Duration(30 * time.Second),
+			MaxBackoff:  Duration(time.Hour),
+			Concurrency: 8,
+		},
+		Uptime:    UptimeConfig{PruneInterval: Duration(time.Hour)},
+		DeepProbe: DeepProbeConfig{Ports: portList{}, CertExpiryWarning: Duration(14 * 24 * time.Hour)},
+		Stuck: StuckConfig{
+			CheckInterval: Duration(time.Minute),
+			Thresholds:    stateThresholds{defaultNodeState: Duration(time.Hour)},
+		},
+		Trace: TraceConfig{ExportInterval: Duration(5 * time.Second), SampleRatio: 1},
+		Readiness: ReadinessConfig{
+			Timeout:        Duration(time.Second),
+			MaxWriteWait:   Duration(500 * time.Millisecond),
+			SampleInterval: Duration(10 * time.Second),
+		},
+		Shutdown: ShutdownConfig{Timeout: Duration(30 * time.Second)},
+	}
+}
+
+// loadConfig loads the config from the file, environment and flags in args
+func loadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("corsproxy", flag.ContinueOnError)
+	cfg, err := loadConfigFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return cfg, nil
+}
+
+// loadConfigFlags loads the config like loadConfig, parsing args with fs. fs
+// may define flags of its own, and the arguments following the flags are
+// left in fs.Args().
+func loadConfigFlags(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := defaultConfig()
+	fields := cfg.fields()
+
+	// Flags take precedence over everything, so only record them for now
+	configFile := fs.String("config", os.Getenv(configFileEnv), "JSON or YAML config file, also set by "+configFileEnv)
+	flagValues := map[string]string{}
+	for _, f := range fields {
+		usage := "Set " + f.path
+		if f.env != "" {
+			usage += ", also set by " + f.env
+		}
+		fs.Var(&recordedFlag{field: f, values: flagValues}, f.path, usage)
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		err = cfg.loadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields {
+		val, ok := os.LookupEnv(f.env)
+		if f.env == "" || !ok || val == "" {
+			continue
+		}
+		err = f.set(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", f.env, err)
+		}
+	}
+
+	for _, f := range fields {
+		val, ok := flagValues[f.path]
+		if !ok {
+			continue
+		}
+		err = f.set(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -%s: %s", f.path, err)
+		}
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the config file at path, which is YAML if its extension
+// is .yaml or .yml and JSON otherwise. Unknown settings are rejected so typos
+// don't go unnoticed.
+func (cfg *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// YAML is converted to JSON so both share the settings' JSON names and
+	// decoding
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return fmt.Errorf("Invalid config file %s: %s", path, err)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(cfg)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the config object")
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+		return fmt.Errorf("Invalid config file %s, line %d: %s", path, line, err)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid config file %s: %s", path, err)
+	}
+	return nil
+}
+
+// yamlToJSON converts a YAML document to JSON
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	v, err = jsonCompatible(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonCompatible converts the maps decoded from YAML, which may have keys of
+// any type, to maps with string keys
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v must be a string", k)
+			}
+			value, err := jsonCompatible(value)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	case []interface{}:
+		for i, value := range v {
+			value, err := jsonCompatible(value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = value
+		}
+	}
+	return v, nil
+}
+
+// Validate checks the config and reports every problem found
+func (cfg *Config) Validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(cfg.Server.Port)
+	check(err == nil && port > 0 && port < 65536, "server.port must be a port number, got %q", cfg.Server.Port)
+	_, err = parseSocketMode(cfg.Server.SocketMode)
+	check(err == nil, "server.socket_mode: %v", err)
+	check(cfg.Server.ReadHeaderTimeout >= 0, "server.read_header_timeout must not be negative")
+	check(cfg.Server.ReadTimeout >= 0, "server.read_timeout must not be negative")
+	check(cfg.Server.WriteTimeout >= 0, "server.write_timeout must not be negative")
+	check(cfg.Server.IdleTimeout >= 0, "server.idle_timeout must not be negative")
+	check(cfg.Server.MaxHeaderBytes > 0, "server.max_header_bytes must be positive")
+	check(cfg.DB.File != "", "db.file is required")
+	check(cfg.Admin.Addr != "", "admin.addr is required")
+	check(cfg.Admin.Addr != net.JoinHostPort(cfg.Server.Host, cfg.Server.Port), "admin.addr must differ from the public listener")
+	check(cfg.Admin.DashboardErrors >= 0, "admin.dashboard_errors must not be negative")
+	check(cfg.Upstream.Timeout > 0, "upstream.timeout must be positive")
+	check(cfg.Upstream.DialTimeout >= 0, "upstream.dial_timeout must not be negative")
+	check(cfg.Upstream.TLSHandshakeTimeout >= 0, "upstream.tls_handshake_timeout must not be negative")
+	check(cfg.Upstream.ResponseHeaderTimeout >= 0, "upstream.response_header_timeout must not be negative")
+	check(cfg.Upstream.KeepAlive >= 0, "upstream.keep_alive must not be negative")
+	check(cfg.Upstream.IdleConnTimeout >= 0, "upstream.idle_conn_timeout must not be negative")
+	check(cfg.Upstream.PoolStatsInterval >= 0, "upstream.pool_stats_interval must not be negative")
+	check(cfg.Upstream.MaxIdleConns >= 0, "upstream.max_idle_conns must not be negative")
+	check(cfg.Upstream.MaxIdleConnsPerHost >= 0, "upstream.max_idle_conns_per_host must not be negative")
+	check(cfg.Upstream.MaxConnsPerHost >= 0, "upstream.max_conns_per_host must not be negative")
+	_, err = parseNetworks(cfg.Targets.Allow)
+	check(err == nil, "targets.allow: %v", err)
+	_, err = parseNetworks(cfg.Targets.Deny)
+	check(err == nil, "targets.deny: %v", err)
+	_, err = newTargetTokenVerifier(cfg.TargetTokens)
+	check(err == nil, "target_tokens: %v", err)
+	check(cfg.TargetTokens.Leeway >= 0, "target_tokens.leeway must not be negative")
+	err = cfg.RateLimit.Routes.validate()
+	check(err == nil, "rate_limit.routes: %v", err)
+	_, err = parseNetworks(cfg.RateLimit.TrustedProxies)
+	check(err == nil, "rate_limit.trusted_proxies: %v", err)
+	check(cfg.RateLimit.MaxClients > 0, "rate_limit.max_clients must be positive")
+	check(cfg.RateLimit.IdleTimeout > 0, "rate_limit.idle_timeout must be positive")
+	if cfg.Outbound.PerTarget.enabled() {
+		err = cfg.Outbound.PerTarget.validate()
+		check(err == nil, "outbound.per_target: %v", err)
+	}
+	if cfg.Outbound.Global.enabled() {
+		err = cfg.Outbound.Global.validate()
+		check(err == nil, "outbound.global: %v", err)
+	}
+	check(cfg.Outbound.MaxTargets > 0, "outbound.max_targets must be positive")
+	_, err = parseAnonymousScopes(cfg.Auth.AnonymousScopes.String())
+	check(err == nil, "auth.anonymous_scopes: %v", err)
+
+	if cfg.TLS.Enabled() {
+		check(cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "", "tls.cert_file and tls.key_file must be set together")
+		_, err = parseTLSVersion(cfg.TLS.MinVersion)
+		check(err == nil, "tls.min_version: %v", err)
+		_, err = parseCipherSuites(cfg.TLS.CipherSuites.String())
+		check(err == nil, "tls.cipher_suites: %v", err)
+		check(cfg.TLS.ReloadInterval > 0, "tls.reload_interval must be positive")
+	} else {
+		check(cfg.TLS.RedirectAddr == "", "tls.redirect_addr requires tls.cert_file and tls.key_file")
+	}
+
+	check(cfg.Sinks.BufferSize > 0, "sinks.buffer_size must be positive")
+	check(cfg.Sinks.JSONPolling.Interval > 0, "sinks.json_polling.interval must be positive")
+	check(cfg.Sinks.JSONPolling.Retain >= cfg.Sinks.JSONPolling.Interval, "sinks.json_polling.retain must be at least the interval")
+	for _, name := range cfg.Sinks.Names {
+		switch name {
+		case sinkWriter, sinkJSONWriter, sinkJSONPolling:
+		case sinkStatsD:
+			check(cfg.Sinks.StatsD.Addr != "", "sinks.statsd.addr is required for the %s sink", sinkStatsD)
+		default:
+			check(false, "sinks.names: unknown health sink %q", name)
+		}
+	}
+
+	err = validateWebhookSubscriptions(cfg.Webhooks.Subscriptions)
+	check(err == nil, "webhooks.subscriptions: %v", err)
+	check(cfg.Webhooks.Interval > 0, "webhooks.interval must be positive")
+	check(cfg.Webhooks.MaxAttempts > 0, "webhooks.max_attempts must be positive")
+	check(cfg.Webhooks.Backoff > 0, "webhooks.backoff must be positive")
+
+	check(cfg.Poller.Interval >= 0, "poller.interval must not be negative")
+	check(cfg.Poller.Jitter >= 0, "poller.jitter must not be negative")
+	check(cfg.Poller.MaxBackoff >= 0, "poller.max_backoff must not be negative")
+	if cfg.Poller.Interval > 0 {
+		check(cfg.Poller.MaxBackoff >= cfg.Poller.Interval, "poller.max_backoff must be at least the interval")
+	}
+	check(cfg.Poller.Concurrency > 0, "poller.concurrency must be positive")
+	check(cfg.Uptime.MaxSampleGap >= 0, "uptime.max_sample_gap must not be negative")
+	check(cfg.Uptime.PruneInterval > 0, "uptime.prune_interval must be positive")
+	for _, p := range cfg.DeepProbe.Ports {
+		check(p > 0 && p < 65536, "deep_probe.ports: invalid port %d", p)
+	}
+	if len(cfg.Stuck.Thresholds) > 0 {
+		check(cfg.Stuck.CheckInterval > 0, "stuck.check_interval must be positive")
+	}
+
+	check(cfg.Trace.SampleRatio >= 0 && cfg.Trace.SampleRatio <= 1, "trace.sample_ratio must be between 0 and 1")
+	if cfg.Trace.Export != "" {
+		check(cfg.Trace.ExportInterval > 0, "trace.export_interval must be positive")
+	}
+	check(cfg.Readiness.Timeout > 0, "readiness.timeout must be positive")
+	check(cfg.Readiness.SampleInterval > 0, "readiness.sample_interval must be positive")
+	check(cfg.Shutdown.DrainDelay >= 0, "shutdown.drain_delay must not be negative")
+	check(cfg.Shutdown.Timeout > 0, "shutdown.timeout must be positive")
+
+	if len(problems) > 0 {
+		return errors.New("Invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with secrets replaced
+func (cfg *Config) Redacted() *Config {
+	c := *cfg
+	for _, f := range c.fields() {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString(redacted)
+		}
+	}
+
+	c.Webhooks.Subscriptions = make(webhookSubscriptions, len(cfg.Webhooks.Subscriptions))
+	for i, sub := range cfg.Webhooks.Subscriptions {
+		sub.Secret = redacted
+		c.Webhooks.Subscriptions[i] = sub
+	}
+	return &c
+}
+
+// printConfig writes the effective config loaded from args with secrets
+// redacted
+func printConfig(w io.Writer, args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
+
+// configField is a single setting of the config
+type configField struct {
+	path       string
+	env        string
+	secret     bool
+	reloadable bool
+	value      reflect.Value
+}
+
+// fields returns every setting of the config, addressed by the JSON path
+// used for its flag
+func (cfg *Config) fields() []configField {
+	return collectConfigFields(reflect.ValueOf(cfg).Elem(), "")
+}
+
+// flagValueType is the type of flag.Value. Structs implementing it are single
+// settings rather than sections.
+var flagValueType = reflect.TypeOf((*flag.Value)(nil)).Elem()
+
+func collectConfigFields(v reflect.Value, prefix string) []configField {
+	fields := []configField{}
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		path := prefix + name
+
+		if sf.Type.Kind() == reflect.Struct && !reflect.PtrTo(sf.Type).Implements(flagValueType) {
+			fields = append(fields, collectConfigFields(v.Field(i), path+".")...)
+			continue
+		}
+		fields = append(fields, configField{
+			path:       path,
+			env:        sf.Tag.Get("env"),
+			secret:     sf.Tag.Get("secret") == "true",
+			reloadable: sf.Tag.Get("reload") == "true",
+			value:      v.Field(i),
+		})
+	}
+	return fields
+}
+
+// set parses s into the setting
+func (f configField) set(s string) error {
+	if v, ok := f.value.Addr().Interface().(flag.Value); ok {
+		return v.Set(s)
+	}
+
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a bool", s)
+		}
+		f.value.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		f.value.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		f.value.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return nil
+}
+
+// recordedFlag is a flag.Value that records the flag's value so it can be
+// applied after the config file and environment
+type recordedFlag struct {
+	field  configField
+	values map[string]string
+}
+
+// String returns the default value of the setting
+func (f *recordedFlag) String() string {
+	if f.field.value.IsValid() {
+		return fmt.Sprint(f.field.value.Interface())
+	}
+	return ""
+}
+
+// Set records the value after checking it parses
+func (f *recordedFlag) Set(s string) error {
+	scratch := configField{value: reflect.New(f.field.value.Type()).Elem()}
+	err := scratch.set(s)
+	if err != nil {
+		return err
+	}
+	f.values[f.field.path] = s
+	return nil
+}
+
+// IsBoolFlag allows bool settings to be set by a flag without a value
+func (f *recordedFlag) IsBoolFlag() bool {
+	return f.field.value.IsValid() && f.field.value.Kind() == reflect.Bool
+}
+
+// Duration is a time.Duration written as a string such as 5m in config files
+type Duration time.Duration
+
+// String formats the duration
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set parses the duration
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads the duration from a string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string such as \"5m\", got %s", b)
+	}
+	return d.Set(s)
+}
+
+// stringList is a list of strings set by a comma separated list
+type stringList []string
+
+// String formats the list
+func (l stringList) String() string {
+	return strings.Join(l, ",")
+}
+
+// Set parses a comma separated list
+func (l *stringList) Set(s string) error {
+	*l = stringList{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// portList is a list of ports set by a comma separated list
+type portList []int
+
+// String formats the list
+func (l portList) String() string {
+	ports := make([]string, len(l))
+	for i, p := range l {
+		ports[i] = strconv.Itoa(p)
+	}
+	return strings.Join(ports, ",")
+}
+
+// Set parses a comma separated list
+func (l *portList) Set(s string) error {
+	ports, err := parsePorts(s)
+	if err != nil {
+		return err
+	}
+	*l = ports
+	return nil
+}
+
+// stateThresholds maps node states to durations, set by a comma separated
+// list of STATE=duration pairs
+type stateThresholds map[string]Duration
+
+// String formats the thresholds
+func (t stateThresholds) String() string {
+	pairs := []string{}
+	for state, d := range t {
+		pairs = append(pairs, state+"="+d.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set parses a comma separated list of STATE=duration pairs
+func (t *stateThresholds) Set(s string) error {
+	thresholds, err := parseStateThresholds(s)
+	if err != nil {
+		return err
+	}
+	*t = stateThresholds{}
+	for state, d := range thresholds {
+		(*t)[state] = Duration(d)
+	}
+	return nil
+}
+
+// UnmarshalJSON replaces the thresholds rather than merging into them, so a
+// config file can drop the default ones
+func (t *stateThresholds) UnmarshalJSON(b []byte) error {
+	thresholds := map[string]Duration{}
+	err := json.Unmarshal(b, &thresholds)
+	if err != nil {
+		return err
+	}
+	*t = thresholds
+	return nil
+}
+
+// Durations returns the thresholds as time.Durations
+func (t stateThresholds) Durations() map[string]time.Duration {
+	thresholds := map[string]time.Duration{}
+	for state, d := range t {
+		thresholds[state] = time.Duration(d)
+	}
+	return thresholds
+}
+
+// rateLimits maps routes to rate limits, set by a comma separated list of
+// route=requests/per:burst limits
+type rateLimits map[string]rateLimit
+
+// String formats the limits
+func (l rateLimits) String() string {
+	pairs := []string{}
+	for route, limit := range l {
+		pairs = append(pairs, route+"="+limit.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set parses a comma separated list of route=requests/per:burst limits
+func (l *rateLimits) Set(s string) error {
+	limits, err := parseRateLimits(s)
+	if err != nil {
+		return err
+	}
+	*l = limits
+	return nil
+}
+
+// UnmarshalJSON replaces the limits rather than merging into them, so a
+// config file can drop the default ones
+func (l *rateLimits) UnmarshalJSON(b []byte) error {
+	limits := map[string]rateLimit{}
+	err := json.Unmarshal(b, &limits)
+	if err != nil {
+		return err
+	}
+	*l = limits
+	return nil
+}
+
+// validate checks the limit of every route
+func (l rateLimits) validate() error {
+	routes := make([]string, 0, len(l))
+	for route := range l {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		if unlimitedRoutes[route] {
+			return fmt.Errorf("%s: Probe endpoints can't be rate limited", route)
+		}
+		err := l[route].validate()
+		if err != nil {
+			return fmt.Errorf("%s: %s", route, err)
+		}
+	}
+	return nil
+}
+
+// webhookSubscriptions is a list of webhook subscriptions set by a JSON list
+type webhookSubscriptions []webhookSubscription
+
+// String formats the subscriptions as JSON
+func (s webhookSubscriptions) String() string {
+	b, _ := json.Marshal([]webhookSubscription(s))
+	return string(b)
+}
+
+// Set parses a JSON list of subscriptions
+func (s *webhookSubscriptions) Set(v string) error {
+	subscriptions, err := parseWebhookSubscriptions(v)
+	if err != nil {
+		return err
+	}
+	*s = subscriptions
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// dashboardPath is the path the admin dashboard is mounted at
+const dashboardPath = "/dashboard/"
+
+// dashboardHistoryLimit is the number of state transitions shown for a node
+const dashboardHistoryLimit = 100
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardFuncs are the functions available to dashboard templates
+var dashboardFuncs = template.FuncMap{
+	"dwell": func(seconds int64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+	"since": func(t time.Time) string {
+		return time.Since(t).Truncate(time.Second).String()
+	},
+	"datetime": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02 15:04:05")
+	},
+	"pathEscape": url.PathEscape,
+}
+
+// dashboard serves the HTML admin dashboard of the fleet
+type dashboard struct {
+	db        *sql.DB
+	errorLog  *errorLogSink
+	templates map[string]*template.Template
+	static    http.Handler
+}
+
+// dashboardNodeRow is a node on the dashboard's node list
+type dashboardNodeRow struct {
+	nodeState
+	LastError *probeError
+}
+
+// dashboardNodesPage is the data of the node list page
+type dashboardNodesPage struct {
+	Nodes  []dashboardNodeRow
+	States []string
+	Counts map[string]int
+	Total  int
+	State  string
+	Query  string
+}
+
+// dashboardNodePage is the data of the node detail page
+type dashboardNodePage struct {
+	Node      *nodeState
+	History   []nodeStateChange
+	Outages   []outage
+	Incidents []incident
+	DeepProbe *deepProbeResult
+}
+
+// dashboardErrorsPage is the data of the health errors page
+type dashboardErrorsPage struct {
+	Errors []healthError
+	Query  string
+}
+
+// newDashboard parses the embedded templates and creates the dashboard
+func newDashboard(db *sql.DB, errorLog *errorLogSink) (*dashboard, error) {
+	d := &dashboard{db: db, errorLog: errorLog, templates: map[string]*template.Template{}}
+
+	for _, page := range []string{"nodes.html", "node.html", "errors.html"} {
+		t, err := template.New(page).Funcs(dashboardFuncs).ParseFS(dashboardFiles,
+			"dashboard/templates/layout.html",
+			"dashboard/templates/"+page,
+		)
+		if err != nil {
+			return nil, err
+		}
+		d.templates[page] = t
+	}
+
+	static, err := fs.Sub(dashboardFiles, "dashboard/static")
+	if err != nil {
+		return nil, err
+	}
+	d.static = http.StripPrefix(dashboardPath+"static/", http.FileServer(http.FS(static)))
+
+	return d, nil
+}
+
+// ServeHTTP routes dashboard requests to their page
+func (d *dashboard) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, dashboardPath)
+	switch {
+	case strings.HasPrefix(path, "static/"):
+		d.static.ServeHTTP(rw, r)
+	case path == "":
+		d.serveNodes(rw, r)
+	case strings.HasPrefix(path, "nodes/"):
+		d.serveNode(rw, r, strings.TrimPrefix(path, "nodes/"))
+	case path == "errors":
+		d.serveErrors(rw, r)
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+// serveNodes lists nodes, limited to those in the state given in the query
+// and whose ip contains the search term q
+func (d *dashboard) serveNodes(rw http.ResponseWriter, r *http.Request) {
+	job := stream.NewJob("dashboard.nodes")
+	page := &dashboardNodesPage{
+		Counts: map[string]int{},
+		State:  r.URL.Query().Get("state"),
+		Query:  strings.TrimSpace(r.URL.Query().Get("q")),
+	}
+
+	states, err := listCurrentNodeStates(d.db)
+	if err != nil {
+		d.fail(rw, job, "dashboard.list_nodes", err)
+		return
+	}
+	lastErrors, err := listLastProbeErrors(d.db)
+	if err != nil {
+		d.fail(rw, job, "dashboard.list_probe_errors", err)
+		return
+	}
+
+	for _, s := range states {
+		page.Counts[s.State]++
+		if page.State != "" && s.State != page.State {
+			continue
+		}
+		if page.Query != "" && !strings.Contains(s.IP, page.Query) {
+			continue
+		}
+
+		row := dashboardNodeRow{nodeState: s}
+		if e, ok := lastErrors[s.IP]; ok {
+			row.LastError = &e
+		}
+		page.Nodes = append(page.Nodes, row)
+	}
+	for state := range page.Counts {
+		page.States = append(page.States, state)
+	}
+	sort.Strings(page.States)
+	page.Total = len(states)
+
+	d.render(rw, job, "nodes.html", page)
+}
+
+// serveNode shows the state history, outages, incidents and latest deep probe
+// of the node at ip
+func (d *dashboard) serveNode(rw http.ResponseWriter, r *http.Request, ip string) {
+	job := stream.NewJob("dashboard.node")
+	job.KeyValue("ip", ip)
+
+	node, err := getCurrentNodeState(d.db, ip)
+	if err != nil {
+		d.fail(rw, job, "dashboard.get_node", err)
+		return
+	}
+	if node == nil {
+		http.NotFound(rw, r)
+		job.Complete(health.Success)
+		return
+	}
+	page := &dashboardNodePage{Node: node}
+
+	page.History, err = listNodeStateHistory(d.db, ip, dashboardHistoryLimit)
+	if err != nil {
+		d.fail(rw, job, "dashboard.list_history", err)
+		return
+	}
+	page.Outages, err = listOutages(d.db, ip)
+	if err != nil {
+		d.fail(rw, job, "dashboard.list_outages", err)
+		return
+	}
+	incidents, err := listIncidents(d.db, "", false)
+	if err != nil {
+		d.fail(rw, job, "dashboard.list_incidents", err)
+		return
+	}
+	for _, inc := range incidents {
+		if inc.IP == ip {
+			page.Incidents = append(page.Incidents, inc)
+		}
+	}
+	page.DeepProbe, err = getDeepProbeResult(d.db, ip)
+	if err != nil {
+		d.fail(rw, job, "dashboard.get_deep_probe", err)
+		return
+	}
+
+	d.render(rw, job, "node.html", page)
+}
+
+// serveErrors lists the most recent errors emitted on the health stream,
+// limited to those whose job, event or message contains the search term q
+func (d *dashboard) serveErrors(rw http.ResponseWriter, r *http.Request) {
+	job := stream.NewJob("dashboard.errors")
+	page := &dashboardErrorsPage{Query: strings.TrimSpace(r.URL.Query().Get("q"))}
+
+	for _, e := range d.errorLog.Recent() {
+		if page.Query != "" && !strings.Contains(e.Job+" "+e.Event+" "+e.Error, page.Query) {
+			continue
+		}
+		page.Errors = append(page.Errors, e)
+	}
+
+	d.render(rw, job, "errors.html", page)
+}
+
+// render executes the page's template into the response
+func (d *dashboard) render(rw http.ResponseWriter, job *health.Job, page string, data interface{}) {
+	var b strings.Builder
+	err := d.templates[page].ExecuteTemplate(&b, "layout", data)
+	if err != nil {
+		d.fail(rw, job, "dashboard.render", err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(rw, b.String())
+	job.Complete(health.Success)
+}
+
+// fail emits err and responds with a generic error page
+func (d *dashboard) fail(rw http.ResponseWriter, job *health.Job, eventName string, err error) {
+	job.EventErr(eventName, err)
+	http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	job.Complete(health.Error)
+}
+
+// requireAdmin protects next with HTTP basic authentication against the
+// admin credentials
+func requireAdmin(user string, password string, next http.Handler) http.Handler {
+	// Compare digests so the comparison doesn't leak the credentials' length
+	wantUser := sha256.Sum256([]byte(user))
+	wantPassword := sha256.Sum256([]byte(password))
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gotUser, gotPassword, ok := r.BasicAuth()
+		gotUserSum := sha256.Sum256([]byte(gotUser))
+		gotPasswordSum := sha256.Sum256([]byte(gotPassword))
+		userMatch := subtle.ConstantTimeCompare(gotUserSum[:], wantUser[:]) == 1
+		passwordMatch := subtle.ConstantTimeCompare(gotPasswordSum[:], wantPassword[:]) == 1
+
+		if !ok || !userMatch || !passwordMatch {
+			if ok {
+				stream.EventKv("admin.auth_failed", health.Kvs{"user": gotUser, "remote_addr": r.RemoteAddr})
+			}
+			rw.Header().Set("WWW-Authenticate", `Basic realm="corsproxy admin", charset="UTF-8"`)
+			http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
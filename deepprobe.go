@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// Deep probe flags
+const (
+	deepProbeFlagUnreachable  = "unreachable"
+	deepProbeFlagCertExpired  = "cert_expired"
+	deepProbeFlagCertExpiring = "cert_expiring"
+	deepProbeFlagPortClosed   = "port_closed"
+)
+
+// portCheck is the result of connecting to a single relay port
+type portCheck struct {
+	Port      int     `json:"port"`
+	Open      bool    `json:"open"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+
+	// Throttled is set if the port wasn't checked because the relay was
+	// over the outbound limits
+	Throttled bool `json:"throttled,omitempty"`
+}
+
+// deepProbeResult is the result of an extended probe of a relay
+type deepProbeResult struct {
+	IP       string    `json:"ip"`
+	ProbedAt time.Time `json:"probed_at"`
+
+	TCPConnectMs   float64 `json:"tcp_connect_ms"`
+	TLSHandshakeMs float64 `json:"tls_handshake_ms"`
+
+	CertSubject   string     `json:"cert_subject"`
+	CertExpiresAt *time.Time `json:"cert_expires_at"`
+
+	Ports []portCheck `json:"ports"`
+	Error string      `json:"error,omitempty"`
+
+	// Flags lists problems found by the probe
+	Flags []string `json:"flags"`
+}
+
+// deepProber measures TCP and TLS latency, certificate expiry and the
+// reachability of additional ports of relays
+type deepProber struct {
+	db            *sql.DB
+	outbound      *outboundLimiter
+	ports         []int
+	expiryWarning time.Duration
+	timeout       time.Duration
+}
+
+// newDeepProber creates a deepProber that checks the given additional ports
+// and flags certificates expiring within expiryWarning. Probes count against
+// the outbound budget.
+func newDeepProber(db *sql.DB, outbound *outboundLimiter, ports []int, expiryWarning time.Duration, timeout time.Duration) *deepProber {
+	return &deepProber{
+		db:            db,
+		outbound:      outbound,
+		ports:         ports,
+		expiryWarning: expiryWarning,
+		timeout:       timeout,
+	}
+}
+
+// parsePorts parses a comma separated list of ports
+func parsePorts(s string) ([]int, error) {
+	ports := []int{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid port: %q", p)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// Probe runs an extended probe of the relay at ip and stores the result. Every
+// connection counts against the outbound budget: it returns nil without
+// probing if the relay is over the outbound limits, and ports reached once
+// it's over them aren't checked.
+func (p *deepProber) Probe(job *health.Job, ip string) *deepProbeResult {
+	kvs := health.Kvs{"ip": ip}
+	if !p.allow(job, ip) {
+		return nil
+	}
+
+	result := &deepProbeResult{IP: ip, ProbedAt: time.Now().UTC(), Ports: []portCheck{}, Flags: []string{}}
+
+	// Time the TCP connection and TLS handshake to the status port
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, relayPort), p.timeout)
+	if err != nil {
+		result.Error = err.Error()
+		result.Flags = append(result.Flags, deepProbeFlagUnreachable)
+		job.EventErrKv("deep_probe.tcp_connect", err, kvs)
+	} else {
+		connected := time.Now()
+		result.TCPConnectMs = durationMs(connected.Sub(start))
+		job.TimingKv("deep_probe.tcp_connect", connected.Sub(start).Nanoseconds(), kvs)
+
+		conn.SetDeadline(time.Now().Add(p.timeout))
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		err = tlsConn.Handshake()
+		if err != nil {
+			result.Error = err.Error()
+			result.Flags = append(result.Flags, deepProbeFlagUnreachable)
+			job.EventErrKv("deep_probe.tls_handshake", err, kvs)
+		} else {
+			handshaked := time.Now()
+			result.TLSHandshakeMs = durationMs(handshaked.Sub(connected))
+			job.TimingKv("deep_probe.tls_handshake", handshaked.Sub(connected).Nanoseconds(), kvs)
+
+			certs := tlsConn.ConnectionState().PeerCertificates
+			if len(certs) > 0 {
+				expiresAt := certs[0].NotAfter.UTC()
+				result.CertSubject = certs[0].Subject.String()
+				result.CertExpiresAt = &expiresAt
+			}
+		}
+		tlsConn.Close()
+	}
+
+	// Flag certificates that have or are about to expire
+	if result.CertExpiresAt != nil {
+		remaining := result.CertExpiresAt.Sub(time.Now())
+		certKvs := health.Kvs{"ip": ip, "subject": result.CertSubject, "expires_at": result.CertExpiresAt.Format(time.RFC3339)}
+		switch {
+		case remaining <= 0:
+			result.Flags = append(result.Flags, deepProbeFlagCertExpired)
+			job.EventKv("deep_probe.cert_expired", certKvs)
+		case remaining <= p.expiryWarning:
+			result.Flags = append(result.Flags, deepProbeFlagCertExpiring)
+			job.EventKv("deep_probe.cert_expiring", certKvs)
+		}
+	}
+
+	// Check the additional ports
+	throttled := false
+	for _, port := range p.ports {
+		check := portCheck{Port: port}
+		throttled = throttled || !p.allow(job, ip)
+		if throttled {
+			check.Throttled = true
+			result.Ports = append(result.Ports, check)
+			continue
+		}
+
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), p.timeout)
+		if err != nil {
+			check.Error = err.Error()
+			result.Flags = append(result.Flags, deepProbeFlagPortClosed+":"+strconv.Itoa(port))
+			job.EventKv("deep_probe.port_closed", health.Kvs{"ip": ip, "port": strconv.Itoa(port)})
+		} else {
+			check.Open = true
+			check.LatencyMs = durationMs(time.Since(start))
+			conn.Close()
+		}
+		result.Ports = append(result.Ports, check)
+	}
+
+	saveDeepProbeResult(job, p.db, result)
+	return result
+}
+
+// allow reports whether a connection may be made to the relay at ip under the
+// outbound limits
+func (p *deepProber) allow(job *health.Job, ip string) bool {
+	allowed, limit, _ := p.outbound.allow(ip, currentSettings(), time.Now())
+	if !allowed {
+		job.EventKv("deep_probe.throttled", health.Kvs{"ip": ip, "limit": limit})
+	}
+	return allowed
+}
+
+// durationMs returns d in fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// saveDeepProbeResult stores the result as the latest deep probe of its node.
+// Errors are emitted on the given job before being returned.
+func saveDeepProbeResult(job *health.Job, db *sql.DB, result *deepProbeResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return job.EventErr("deep_probe.marshal", err)
+	}
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO deep_probes (ip, result, probed_at) VALUES (?, ?, CURRENT_TIMESTAMP);`,
+		result.IP, string(body))
+	if err != nil {
+		return job.EventErr("deep_probe.save", err)
+	}
+	return nil
+}
+
+// getDeepProbeResult returns the latest deep probe of the node at ip or nil
+// if the node hasn't been deep probed
+func getDeepProbeResult(db *sql.DB, ip string) (*deepProbeResult, error) {
+	var body string
+	err := db.QueryRow(`SELECT result FROM deep_probes WHERE ip = ?;`, ip).Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &deepProbeResult{}
+	err = json.Unmarshal([]byte(body), result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
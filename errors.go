@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/gocraft/health"
+)
+
+// Error classes attached to failed jobs
+const (
+	errorClassTimeout        = "timeout"
+	errorClassDNS            = "dns"
+	errorClassConnection     = "connection"
+	errorClassTLS            = "tls"
+	errorClassUpstreamStatus = "upstream_status"
+	errorClassParse          = "parse"
+	errorClassInternal       = "internal"
+)
+
+// upstreamStatusError is returned when a relay responds with a non-200 status
+type upstreamStatusError struct {
+	StatusCode int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("Error in HTTP request: %d", e.StatusCode)
+}
+
+// errorClass returns a coarse, low-cardinality classification of err
+func errorClass(err error) string {
+	// Unwrap errors emitted on health jobs
+	switch e := err.(type) {
+	case *health.UnmutedError:
+		err = e.Err
+	case *health.MutedError:
+		err = e.Err
+	}
+
+	var (
+		netErr       net.Error
+		dnsErr       *net.DNSError
+		opErr        *net.OpError
+		statusErr    *upstreamStatusError
+		syntaxErr    *json.SyntaxError
+		typeErr      *json.UnmarshalTypeError
+		recordErr    tls.RecordHeaderError
+		certErr      *tls.CertificateVerificationError
+		unknownAuth  x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		certInvalErr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		return errorClassUpstreamStatus
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return errorClassParse
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errorClassTimeout
+	case errors.As(err, &dnsErr):
+		return errorClassDNS
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &unknownAuth),
+		errors.As(err, &hostnameErr), errors.As(err, &certInvalErr):
+		return errorClassTLS
+	case errors.As(err, &opErr):
+		return errorClassConnection
+	}
+	return errorClassInternal
+}
@@ -4,8 +4,14 @@ import (
 	"crypto/tls"
 	"database/sql"
 	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gocraft/health"
@@ -21,49 +27,393 @@ const nodeTableSchema = `CREATE TABLE IF NOT EXISTS nodes (
   PRIMARY KEY(ip, state)
   );`
 
-// HTTPTimeout is the amount of time to wait for a read/write timeout on the request
+// incidentTableSchema is a SQL statement that creates the incidents table
+const incidentTableSchema = `CREATE TABLE IF NOT EXISTS incidents (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  kind TEXT NOT NULL,
+  ip TEXT NOT NULL,
+  state TEXT NOT NULL,
+  threshold_seconds INTEGER NOT NULL,
+  opened_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  resolved_at DATETIME
+  );`
+
+// webhookDeliveryTableSchema is a SQL statement that creates the webhook outbox
+const webhookDeliveryTableSchema = `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  subscription TEXT NOT NULL,
+  event TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending',
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT NOT NULL DEFAULT '',
+  next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+  );`
+
+// probeTableSchema is a SQL statement that creates the table of probe results
+const probeTableSchema = `CREATE TABLE IF NOT EXISTS probes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  ip TEXT NOT NULL,
+  reachable BOOLEAN NOT NULL,
+  error TEXT NOT NULL DEFAULT '',
+  probed_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+  );
+CREATE INDEX IF NOT EXISTS probes_ip_probed_at ON probes (ip, probed_at);`
+
+// deepProbeTableSchema is a SQL statement that creates the table of the latest
+// deep probe result of each node
+const deepProbeTableSchema = `CREATE TABLE IF NOT EXISTS deep_probes (
+  ip TEXT NOT NULL PRIMARY KEY,
+  result TEXT NOT NULL,
+  probed_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+  );`
+
+// nodeStateHistoryTableSchema is a SQL statement that creates the table of
+// node state transitions
+const nodeStateHistoryTableSchema = `CREATE TABLE IF NOT EXISTS node_state_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  ip TEXT NOT NULL,
+  from_state TEXT NOT NULL,
+  to_state TEXT NOT NULL,
+  changed_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+  );
+CREATE INDEX IF NOT EXISTS node_state_history_ip ON node_state_history (ip, id);`
+
+// schema is the list of SQL statements run when opening the database
+var schema = []string{
+	nodeTableSchema,
+	incidentTableSchema,
+	webhookDeliveryTableSchema,
+	probeTableSchema,
+	deepProbeTableSchema,
+	nodeStateHistoryTableSchema,
+	apiKeyTableSchema,
+}
+
+// HTTPTimeout is the amount of time to wait for a read/write timeout on the
+// request, as configured at startup. Requests to relays and webhooks use the
+// live upstream timeout instead, which may change on reload.
 var HTTPTimeout = 15 * time.Second
 
-// HTTPClient is a custom HTTP client that doesn't check tls signature chains
+// HTTPClient is a custom HTTP client that doesn't check tls signature chains.
+// Requests time out after the live upstream timeout.
 var HTTPClient = &http.Client{
-	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	},
-	Timeout: HTTPTimeout,
+	Transport: newUpstreamTransport(defaultConfig().Upstream, upstreamPoolStats),
 }
 
 // stream is a health.Stream used for instrumentation
 var stream *health.Stream
 
+// worker is a background task that runs for the lifetime of the server
+type worker interface {
+	Start()
+	Stop()
+}
+
 func main() {
+	err := runCLI(os.Stdout, os.Args[1:])
+	switch err.(type) {
+	case nil:
+	case usageError:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	default:
+		if err == flag.ErrHelp {
+			return
+		}
+		if err != errCommandFailed {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// serve runs the proxy with the config loaded from args until it's shut down
+func serve(cfg *Config, args []string) {
+	HTTPTimeout = time.Duration(cfg.Upstream.Timeout)
+	HTTPClient.Transport = newUpstreamTransport(cfg.Upstream, upstreamPoolStats)
+
 	// Create health stream
 	stream = health.NewStream()
-	stream.AddSink(&health.WriterSink{os.Stdout})
+	metrics := newPrometheusSink()
+	stream.AddSink(metrics)
+	errorLog := newErrorLogSink(cfg.Admin.DashboardErrors)
+	stream.AddSink(errorLog)
+	sinks, err := configureSinks(stream, cfg.Sinks)
+	if err != nil {
+		stream.AddSink(&health.WriterSink{Writer: os.Stdout})
+		stream.EventErr("configure_sinks", err)
+		os.Exit(1)
+	}
+
+	// fatal emits err and exits once the sinks have written it
+	fatal := func(eventName string, err error, kvs health.Kvs) {
+		stream.EventErrKv(eventName, err, kvs)
+		sinks.Close(time.Second)
+		os.Exit(1)
+	}
 
-	// Get host and port to bind to
-	port := getOSEnvString("CORS_PROXY_PORT", "8080")
-	host := getOSEnvString("CORS_PROXY_HOST", "127.0.0.1")
-	dbFile := getOSEnvString("CORS_PROXY_DB_FILE", "/opt/corsproxy.db")
+	// Use the sockets passed by the service manager, if any
+	activated, err := activatedListeners()
+	if err != nil {
+		fatal("socket_activation", err, nil)
+	}
 
 	// Open DB and create logging middleware
-	db, err := openDB(dbFile)
+	db, err := openDB(cfg.DB.File)
 	if err != nil {
-		stream.EventErrKv("open_db", err, health.Kvs{"file": dbFile})
-		return
+		fatal("open_db", err, health.Kvs{"file": cfg.DB.File})
 	}
 
-	updateNodeStateMiddleware, err := newUpdateNodeStateMiddleware(db)
+	// Create the webhook dispatcher
+	webhooks := newWebhookDispatcher(db,
+		cfg.Webhooks.Subscriptions,
+		time.Duration(cfg.Webhooks.Interval),
+		cfg.Webhooks.MaxAttempts,
+		time.Duration(cfg.Webhooks.Backoff),
+	)
+
+	// Reload live settings on SIGHUP or request
+	reloader, err := newConfigReloader(args, cfg, webhooks)
 	if err != nil {
-		stream.EventErr("new_log_middleware", err)
-		return
+		fatal("new_config_reloader", err, nil)
 	}
 
+	// Serve the admin listener, with the dashboard if admin credentials are
+	// set. Everything else requires an API key.
+	adminRouter := newAdminRouter(newAuthMiddleware(db),
+		db,
+		cfg.SampleGap(),
+		metrics,
+		sinks.polling,
+		newReloadHandler(reloader),
+		newDebugHandler(db),
+	)
+	var dashboardHandler http.Handler
+	if cfg.Admin.Password != "" {
+		d, err := newDashboard(db, errorLog)
+		if err != nil {
+			fatal("new_dashboard", err, nil)
+		}
+		dashboardHandler = requireAdmin(cfg.Admin.User, cfg.Admin.Password, d)
+	}
+	adminServer := &http.Server{
+		Addr:              cfg.Admin.Addr,
+		Handler:           newAdminMux(adminRouter, dashboardHandler),
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+	}
+	go func() {
+		l, err := listen(activated, activatedAdmin, adminServer.Addr)
+		if err != nil {
+			stream.EventErrKv("admin_listen", err, health.Kvs{"addr": adminServer.Addr})
+			return
+		}
+		stream.EventKv("admin_listening", health.Kvs{"addr": l.Addr().String()})
+		err = adminServer.Serve(l)
+		if err != http.ErrServerClosed {
+			stream.EventErrKv("admin_listen", err, health.Kvs{"addr": l.Addr().String()})
+		}
+	}()
+
+	updateNodeStateMiddleware, err := newUpdateNodeStateMiddleware(db, webhooks)
+	if err != nil {
+		fatal("new_log_middleware", err, nil)
+	}
+
+	// Create background workers
+	workers := []worker{webhooks, reloader, newProbePruner(db, time.Duration(cfg.Uptime.PruneInterval))}
+
+	// Share the outbound budget between the proxy, the poller and deep probes
+	outbound := newOutboundLimiter(cfg.Outbound.MaxTargets)
+
+	var prober *deepProber
+	if cfg.DeepProbe.Enabled {
+		prober = newDeepProber(db,
+			outbound,
+			cfg.DeepProbe.Ports,
+			time.Duration(cfg.DeepProbe.CertExpiryWarning),
+			HTTPTimeout,
+		)
+	}
+
+	if cfg.Poller.Interval > 0 {
+		workers = append(workers, newPoller(db,
+			webhooks,
+			prober,
+			outbound,
+			time.Duration(cfg.Poller.Interval),
+			time.Duration(cfg.Poller.Jitter),
+			time.Duration(cfg.Poller.MaxBackoff),
+			cfg.Poller.Concurrency,
+		))
+	}
+
+	if len(cfg.Stuck.Thresholds) > 0 {
+		workers = append(workers, newStuckDetector(db,
+			time.Duration(cfg.Stuck.CheckInterval),
+			cfg.Stuck.Thresholds.Durations(),
+		))
+	}
+
+	watchdog, err := watchdogInterval()
+	if err != nil {
+		fatal("systemd.watchdog", err, nil)
+	}
+	if watchdog > 0 {
+		workers = append(workers, newWatchdogNotifier(watchdog))
+	}
+
+	if cfg.Upstream.PoolStatsInterval > 0 {
+		workers = append(workers, newPoolStatsReporter(upstreamPoolStats, time.Duration(cfg.Upstream.PoolStatsInterval)))
+	}
+
+	readiness := newReadinessChecker(db,
+		sinks,
+		time.Duration(cfg.Readiness.Timeout),
+		time.Duration(cfg.Readiness.MaxWriteWait),
+		time.Duration(cfg.Readiness.SampleInterval),
+	)
+	workers = append(workers, readiness)
+
+	// Serve HTTPS if a certificate is configured
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		var reloader *certReloader
+		tlsConfig, reloader, err = newServerTLSConfig(cfg.TLS.CertFile,
+			cfg.TLS.KeyFile,
+			cfg.TLS.MinVersion,
+			cfg.TLS.CipherSuites.String(),
+			time.Duration(cfg.TLS.ReloadInterval),
+		)
+		if err != nil {
+			fatal("configure_tls", err, health.Kvs{"cert_file": cfg.TLS.CertFile, "key_file": cfg.TLS.KeyFile})
+		}
+		workers = append(workers, reloader)
+	}
+
+	// Export spans last so it's the last worker to stop
+	if cfg.Trace.Export != "" {
+		exporter, err := newSpanExporter(cfg.Trace.Export, time.Duration(cfg.Trace.ExportInterval))
+		if err != nil {
+			fatal("new_span_exporter", err, nil)
+		}
+		tracer = newTracer(exporter, cfg.Trace.SampleRatio)
+		workers = append(workers, exporter)
+	}
+
+	// Start background workers
+	for _, w := range workers {
+		w.Start()
+	}
+
+	ServerTimingEnabled = cfg.Server.ServerTiming
+
 	// Create a router to the proxy request handler
-	router := newRouter(updateNodeStateMiddleware)
+	limiter := newRateLimiter(cfg.RateLimit.MaxClients, time.Duration(cfg.RateLimit.IdleTimeout))
+	router := newRouter(updateNodeStateMiddleware,
+		newRateLimitMiddleware(limiter),
+		db,
+		outbound,
+		readiness,
+	)
+	server := newHTTPServer(net.JoinHostPort(cfg.Server.Host, cfg.Server.Port), router, cfg.Server)
+	server.TLSConfig = tlsConfig
+	servers := []*http.Server{server, adminServer}
+
+	// Listen before serving so the service manager is only told we're ready
+	// once connections are accepted
+	var listener net.Listener
+	if _, ok := activated[activatedPublic]; !ok && cfg.Server.Socket != "" {
+		mode, _ := parseSocketMode(cfg.Server.SocketMode)
+		listener, err = listenUnix(cfg.Server.Socket, mode)
+	} else {
+		listener, err = listen(activated, activatedPublic, server.Addr)
+	}
+	if err != nil {
+		fatal("server_listen", err, health.Kvs{"addr": server.Addr, "socket": cfg.Server.Socket})
+	}
+
+	// Optionally redirect HTTP to HTTPS
+	if server.TLSConfig != nil {
+		_, redirectActivated := activated[activatedRedirect]
+		if redirectAddr := cfg.TLS.RedirectAddr; redirectAddr != "" || redirectActivated {
+			redirectServer := newHTTPServer(redirectAddr, newHTTPSRedirectHandler(cfg.Server.Port), cfg.Server)
+			servers = append(servers, redirectServer)
+			l, err := listen(activated, activatedRedirect, redirectAddr)
+			if err != nil {
+				fatal("redirect_listen", err, health.Kvs{"addr": redirectAddr})
+			}
+			go func() {
+				stream.EventKv("redirect_listening", health.Kvs{"addr": l.Addr().String()})
+				err := redirectServer.Serve(l)
+				if err != http.ErrServerClosed {
+					fatal("redirect_listen", err, health.Kvs{"addr": l.Addr().String()})
+				}
+			}()
+		}
+	}
+
+	// Shut down gracefully on the first signal and immediately on the second
+	shutdown := &gracefulShutdown{
+		servers:    servers,
+		readiness:  readiness,
+		workers:    workers,
+		db:         db,
+		drainDelay: time.Duration(cfg.Shutdown.DrainDelay),
+		timeout:    time.Duration(cfg.Shutdown.Timeout),
+	}
+	exitCode := make(chan int, 1)
+	go func() {
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		go func() {
+			<-signals
+			fatal("shutdown.forced", errors.New("Received second signal"), nil)
+		}()
+
+		if shutdown.Run(sig) {
+			exitCode <- 0
+		} else {
+			exitCode <- 1
+		}
+	}()
+
+	// Start serving
+	stream.EventKv("server_listening", health.Kvs{
+		"network": listener.Addr().Network(),
+		"addr":    listener.Addr().String(),
+		"tls":     strconv.FormatBool(server.TLSConfig != nil),
+	})
+	notify("READY=1")
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		fatal("server_serve", err, health.Kvs{"addr": listener.Addr().String()})
+	}
 
-	// Start listening
-	stream.EventKv("server_listening", health.Kvs{"host": host, "port": port})
-	http.ListenAndServe(host+":"+port, router)
+	code := <-exitCode
+	sinks.Close(time.Second)
+	os.Exit(code)
+}
+
+// newHTTPServer creates a server for handler on addr with the configured
+// timeouts and limits
+func newHTTPServer(addr string, handler http.Handler, cfg ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
 }
 
 // openDB opens a sqlite connection and creates the database/schema if it
@@ -78,21 +428,17 @@ func openDB(dbFile string) (*sql.DB, error) {
 		return nil, err
 	}
 
-	// Create table if not exists
-	_, err = db.Exec(nodeTableSchema)
-	if err != nil {
-		return nil, err
+	// Create tables if not exists
+	for _, stmt := range schema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return db, nil
-}
+	// sqlite only supports a single writer, so serialize access from the
+	// request handlers and the poller
+	db.SetMaxOpenConns(1)
 
-// getOSEnvString returns the environment variable with the given name or the
-// defaultVal if no env var is set for the name
-func getOSEnvString(name string, defaultVal string) string {
-	val := os.Getenv(name)
-	if val != "" {
-		return val
-	}
-	return defaultVal
+	return db, nil
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// defaultNodeState is the state recorded for a node that couldn't report a
+// status of its own
+const defaultNodeState = "INSTALLING_OPENBAZAAR_RELAY"
+
+// updateNodeStateQuery upserts the (ip, state) row, keeping its original
+// created_at if the node has been in this state before
+const updateNodeStateQuery = `
+  WITH new (ip, state) AS ( VALUES(?, ?) )
+  INSERT OR REPLACE INTO nodes (ip, state, updated_at, created_at)
+  SELECT new.ip, new.state, CURRENT_TIMESTAMP, COALESCE(old.created_at, CURRENT_TIMESTAMP)
+  FROM new
+    LEFT JOIN nodes AS old
+    ON new.ip = old.ip AND new.state = old.state
+  LIMIT 1;
+`
+
+// nodeStateTransition is a change in the state of a node
+type nodeStateTransition struct {
+	IP   string
+	From string
+	To   string
+	At   time.Time
+}
+
+// updateNodeState persists the given state for the node at ip and returns the
+// transition if the state differs from the node's previous state, or nil if
+// it doesn't. Webhook deliveries of the transition are queued in the same
+// transaction. Errors are emitted on the given job before being returned.
+func updateNodeState(job *health.Job, db *sql.DB, webhooks *webhookDispatcher, ip string, state string) (*nodeStateTransition, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, job.EventErr("update_node_state.begin", err)
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRow(`SELECT state FROM nodes WHERE ip = ? ORDER BY updated_at DESC, rowid DESC LIMIT 1;`, ip).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, job.EventErr("update_node_state.select_previous", err)
+	}
+
+	updateStmt, err := tx.Prepare(updateNodeStateQuery)
+	if err != nil {
+		return nil, job.EventErr("update_node_state.prepare", err)
+	}
+	defer updateStmt.Close()
+
+	_, err = updateStmt.Exec(ip, state)
+	if err != nil {
+		return nil, job.EventErr("update_node_state.execute", err)
+	}
+
+	var transition *nodeStateTransition
+	if previous != state {
+		_, err = tx.Exec(`INSERT INTO node_state_history (ip, from_state, to_state) VALUES (?, ?, ?);`, ip, previous, state)
+		if err != nil {
+			return nil, job.EventErr("update_node_state.insert_history", err)
+		}
+
+		transition = &nodeStateTransition{IP: ip, From: previous, To: state, At: time.Now().UTC()}
+		err = webhooks.Notify(job, tx, transition)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, job.EventErr("update_node_state.commit", err)
+	}
+	return transition, nil
+}
+
+// persistProbeResult records the outcome of fetching the status of the node at
+// ip and persists its resulting state, queueing webhooks of any transition
+func persistProbeResult(ctx context.Context, job *health.Job, db *sql.DB, webhooks *webhookDispatcher, ip string, state string, probeErr error) {
+	_, span := tracer.StartSpan(ctx, "sqlite.persist_probe_result", spanKindInternal)
+	span.SetAttribute("db.system", "sqlite")
+	span.SetAttribute("net.peer.name", ip)
+	span.SetAttribute("node.state", state)
+	defer span.Finish()
+
+	recordProbe(job, db, ip, probeErr)
+
+	transition, err := updateNodeState(job, db, webhooks, ip, state)
+	if err != nil {
+		span.SetError(err)
+		return
+	}
+	span.SetAttribute("node.transition", transition != nil)
+}
+
+// listNodeIPs returns the ip of every node that has been registered
+func listNodeIPs(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT ip FROM nodes ORDER BY ip;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ips := []string{}
+	for rows.Next() {
+		var ip string
+		err = rows.Scan(&ip)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, rows.Err()
+}
+
+// nodeState is the most recent state recorded for a node
+type nodeState struct {
+	IP        string    `json:"ip"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// EnteredAt is when the node last entered its current state and
+	// DwellSeconds the time it has been in it since
+	EnteredAt    time.Time `json:"entered_at"`
+	DwellSeconds int64     `json:"dwell_seconds"`
+}
+
+// currentNodeStatesQuery selects the most recently written row for each node
+// along with when it last entered that state, in seconds since the epoch. A
+// node's row for a state is kept when it returns to the state, so its
+// created_at is only used for nodes recorded before their history.
+const currentNodeStatesQuery = `
+  SELECT n.ip, n.state, n.created_at, n.updated_at,
+    CAST(strftime('%s', COALESCE((
+      SELECT h.changed_at FROM node_state_history AS h
+      WHERE h.ip = n.ip AND h.to_state = n.state
+      ORDER BY h.id DESC
+      LIMIT 1
+    ), n.created_at)) AS INTEGER)
+  FROM nodes AS n
+  WHERE (? = '' OR n.ip = ?) AND n.rowid = (
+    SELECT rowid FROM nodes WHERE ip = n.ip
+    ORDER BY updated_at DESC, rowid DESC
+    LIMIT 1
+  )
+  ORDER BY n.ip;
+`
+
+// listCurrentNodeStates returns the current state of every registered node
+func listCurrentNodeStates(db *sql.DB) ([]nodeState, error) {
+	return queryCurrentNodeStates(db, "")
+}
+
+// getCurrentNodeState returns the current state of the node at ip or nil if
+// the node isn't registered
+func getCurrentNodeState(db *sql.DB, ip string) (*nodeState, error) {
+	states, err := queryCurrentNodeStates(db, ip)
+	if err != nil || len(states) == 0 {
+		return nil, err
+	}
+	return &states[0], nil
+}
+
+// queryCurrentNodeStates returns the current state of the node at ip, or of
+// every node if ip is empty
+func queryCurrentNodeStates(db *sql.DB, ip string) ([]nodeState, error) {
+	rows, err := db.Query(currentNodeStatesQuery, ip, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	states := []nodeState{}
+	for rows.Next() {
+		var s nodeState
+		var enteredAt int64
+		err = rows.Scan(&s.IP, &s.State, &s.CreatedAt, &s.UpdatedAt, &enteredAt)
+		if err != nil {
+			return nil, err
+		}
+		s.EnteredAt = time.Unix(enteredAt, 0).UTC()
+		s.DwellSeconds = int64(now.Sub(s.EnteredAt) / time.Second)
+		if s.DwellSeconds < 0 {
+			s.DwellSeconds = 0
+		}
+		states = append(states, s)
+	}
+
+	return states, rows.Err()
+}
+
+// nodeStateChange is a recorded transition in the state of a node
+type nodeStateChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// listNodeStateHistory returns up to limit of the most recent state
+// transitions of the node at ip, most recent first
+func listNodeStateHistory(db *sql.DB, ip string, limit int) ([]nodeStateChange, error) {
+	rows, err := db.Query(`SELECT from_state, to_state, changed_at
+    FROM node_state_history
+    WHERE ip = ?
+    ORDER BY id DESC
+    LIMIT ?;`, ip, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []nodeStateChange{}
+	for rows.Next() {
+		var c nodeStateChange
+		err = rows.Scan(&c.From, &c.To, &c.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, rows.Err()
+}
+
+// nodeTables are the tables holding data about individual nodes, by ip
+var nodeTables = []string{"nodes", "node_state_history", "probes", "deep_probes", "incidents"}
+
+// deleteNode deletes the node at ip and everything recorded about it, and
+// returns the rows deleted from each table or nil if the node isn't
+// registered
+func deleteNode(db *sql.DB, ip string) (map[string]int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deleted := map[string]int64{}
+	for _, table := range nodeTables {
+		res, err := tx.Exec(`DELETE FROM `+table+` WHERE ip = ?;`, ip)
+		if err != nil {
+			return nil, err
+		}
+		deleted[table], err = res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if deleted["nodes"] == 0 {
+		return nil, nil
+	}
+	return deleted, tx.Commit()
+}
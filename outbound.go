@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+// outboundIdleTimeout is how long the bucket of a target is kept unused
+const outboundIdleTimeout = 10 * time.Minute
+
+// globalOutboundKey is the key of the global budget, which no ip matches
+const globalOutboundKey = "*"
+
+// Limits an outbound request can be throttled by
+const (
+	outboundLimitTarget = "target"
+	outboundLimitGlobal = "global"
+)
+
+// outboundLimiter limits the requests made to relays by the proxy, the poller
+// and the deep prober, both per target and in total, under the live limits
+type outboundLimiter struct {
+	buckets *rateLimiter
+}
+
+// newOutboundLimiter creates an outboundLimiter keeping the buckets of up to
+// maxTargets targets
+func newOutboundLimiter(maxTargets int) *outboundLimiter {
+	return &outboundLimiter{buckets: newRateLimiter(maxTargets+1, outboundIdleTimeout)}
+}
+
+// allow reports whether a request may be made to ip. If not, it returns the
+// limit that was reached and how long until it allows a request again.
+func (l *outboundLimiter) allow(ip string, s *liveSettings, now time.Time) (bool, string, time.Duration) {
+	if s.outboundPerTarget.enabled() {
+		result := l.buckets.take(ip, s.outboundPerTarget, now)
+		if !result.allowed {
+			return false, outboundLimitTarget, result.retryAfter
+		}
+	}
+	if s.outboundGlobal.enabled() {
+		result := l.buckets.take(globalOutboundKey, s.outboundGlobal, now)
+		if !result.allowed {
+			// The request isn't made, so it doesn't count against the target
+			if s.outboundPerTarget.enabled() {
+				l.buckets.refund(ip, s.outboundPerTarget)
+			}
+			return false, outboundLimitGlobal, result.retryAfter
+		}
+	}
+	return true, "", 0
+}
+
+// serveLastKnownState answers a request for the status of a throttled target
+// with the state last recorded for it, or 503 if there's none
+func serveLastKnownState(c *Context, rw web.ResponseWriter, db *sql.DB, ip string, retryAfter time.Duration) {
+	node, err := getCurrentNodeState(db, ip)
+	if err != nil {
+		c.err = err
+		c.job.EventErr("outbound.last_known_state", c.err)
+		return
+	}
+
+	if node == nil {
+		c.cacheStatus = "miss"
+		c.job.Event("outbound.throttled.unserved")
+		rw.Header().Set("Retry-After", ceilSeconds(retryAfter))
+		writeJSONStatus(c, rw, http.StatusServiceUnavailable, map[string]string{"error": "Target is rate limited"})
+		return
+	}
+
+	c.cacheStatus = "stale"
+	c.nodeStatus = node.State
+	c.job.Event("outbound.served_stale")
+	age := time.Since(node.UpdatedAt)
+	if age < 0 {
+		age = 0
+	}
+	rw.Header().Set("Age", strconv.FormatInt(int64(age.Seconds()), 10))
+	rw.Header().Set("Cache-Status", "corsproxy; hit; detail=throttled")
+	writeJSON(c, rw, &StatusResponse{Status: node.State})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// poller periodically probes every registered node and persists its state so
+// the database stays fresh when no browser is asking
+type poller struct {
+	db          *sql.DB
+	webhooks    *webhookDispatcher
+	deepProber  *deepProber
+	outbound    *outboundLimiter
+	interval    time.Duration
+	jitter      time.Duration
+	maxBackoff  time.Duration
+	concurrency int
+
+	mu      sync.Mutex
+	backoff map[string]*nodeBackoff
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// nodeBackoff tracks consecutive probe failures for a single node
+type nodeBackoff struct {
+	failures    int
+	nextAttempt time.Time
+}
+
+// newPoller creates a poller that probes nodes every interval, plus up to
+// jitter, with at most concurrency probes in flight at once. If deepProber is
+// not nil every probe is followed by a deep probe. Probes count against the
+// outbound budget shared with the status request proxy handler.
+func newPoller(db *sql.DB, webhooks *webhookDispatcher, deepProber *deepProber, outbound *outboundLimiter, interval time.Duration, jitter time.Duration, maxBackoff time.Duration, concurrency int) *poller {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &poller{
+		db:          db,
+		webhooks:    webhooks,
+		deepProber:  deepProber,
+		outbound:    outbound,
+		interval:    interval,
+		jitter:      jitter,
+		maxBackoff:  maxBackoff,
+		concurrency: concurrency,
+		backoff:     map[string]*nodeBackoff{},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start begins polling in the background
+func (p *poller) Start() {
+	go p.loop()
+}
+
+// Stop signals the poller to stop and waits for the current cycle to finish
+func (p *poller) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *poller) loop() {
+	defer close(p.done)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(p.nextDelay()):
+			p.runCycle()
+		}
+	}
+}
+
+// nextDelay returns the interval plus a random jitter
+func (p *poller) nextDelay() time.Duration {
+	if p.jitter <= 0 {
+		return p.interval
+	}
+	return p.interval + time.Duration(rand.Int63n(int64(p.jitter)))
+}
+
+// runCycle probes every node that isn't backing off
+func (p *poller) runCycle() {
+	job := stream.NewJob("poller.cycle")
+
+	ips, err := listNodeIPs(p.db)
+	if err != nil {
+		job.EventErr("poller.list_nodes", err)
+		job.Complete(health.Error)
+		return
+	}
+	p.forgetRemoved(ips)
+
+	var (
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, p.concurrency)
+		now       = time.Now()
+		probed    = 0
+		cancelled = false
+	)
+	for _, ip := range ips {
+		if !p.isDue(ip, now) {
+			continue
+		}
+
+		select {
+		case <-p.stop:
+			cancelled = true
+		case sem <- struct{}{}:
+		}
+		if cancelled {
+			break
+		}
+
+		probed++
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			p.probe(job, ip)
+		}(ip)
+	}
+	wg.Wait()
+
+	job.Gauge("poller.nodes", float64(len(ips)))
+	job.Gauge("poller.probed", float64(probed))
+	if cancelled {
+		job.Complete(health.Junk)
+		return
+	}
+	job.Complete(health.Success)
+}
+
+// probe fetches and persists the state of a single node, the same way
+// the status request proxy handler and the update node state middleware do.
+// Nodes over the outbound limits are deferred until they allow a request.
+func (p *poller) probe(job *health.Job, ip string) {
+	s := currentSettings()
+	if !s.allowTarget(ip) {
+		job.EventKv("poller.target_not_allowed", health.Kvs{"ip": ip})
+		return
+	}
+
+	allowed, limit, retryAfter := p.outbound.allow(ip, s, time.Now())
+	if !allowed {
+		p.deferProbe(ip, retryAfter)
+		job.EventKv("poller.throttled", health.Kvs{"ip": ip, "limit": limit, "retry_after": retryAfter.String()})
+		return
+	}
+
+	state := defaultNodeState
+	ctx, span := tracer.StartSpan(withRequestID(context.Background(), newRequestID()), "poller.probe", spanKindInternal)
+	span.SetAttribute("net.peer.name", ip)
+	defer span.Finish()
+
+	_, status, _, err := fetchNodeStatus(ctx, job, ip)
+	if err == nil {
+		state = status.Status
+	} else {
+		span.SetError(err)
+	}
+	p.recordResult(job, ip, err)
+
+	persistProbeResult(ctx, job, p.db, p.webhooks, ip, state, err)
+
+	if p.deepProber != nil {
+		p.deepProber.Probe(job, ip)
+	}
+}
+
+// isDue reports whether the node should be probed in this cycle
+func (p *poller) isDue(ip string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.backoff[ip]
+	return !ok || !now.Before(b.nextAttempt)
+}
+
+// forgetRemoved drops the backoff of nodes that are no longer registered
+func (p *poller) forgetRemoved(ips []string) {
+	registered := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		registered[ip] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ip := range p.backoff {
+		if !registered[ip] {
+			delete(p.backoff, ip)
+		}
+	}
+}
+
+// deferProbe skips the node until delay has passed, without counting it as a
+// failure
+func (p *poller) deferProbe(ip string, delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok := p.backoff[ip]
+	if !ok {
+		b = &nodeBackoff{}
+		p.backoff[ip] = b
+	}
+	if next := time.Now().Add(delay); next.After(b.nextAttempt) {
+		b.nextAttempt = next
+	}
+}
+
+// recordResult resets the backoff of a reachable node, or doubles the time
+// until the next attempt of an unreachable one, up to maxBackoff
+func (p *poller) recordResult(job *health.Job, ip string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		delete(p.backoff, ip)
+		return
+	}
+
+	b, ok := p.backoff[ip]
+	if !ok {
+		b = &nodeBackoff{}
+		p.backoff[ip] = b
+	}
+	b.failures++
+
+	delay := backoffDelay(p.interval, b.failures, p.maxBackoff)
+	b.nextAttempt = time.Now().Add(delay)
+
+	job.EventKv("poller.backoff", health.Kvs{
+		"ip":       ip,
+		"failures": strconv.Itoa(b.failures),
+		"delay":    delay.String(),
+	})
+}
+
+// backoffDelay returns base doubled n times, up to max. It stops doubling
+// once max is reached so the delay can't overflow.
+func backoffDelay(base time.Duration, n int, max time.Duration) time.Duration {
+	delay := base
+	for i := 0; i < n && delay > 0 && delay < max; i++ {
+		if delay > max/2 {
+			return max
+		}
+		delay *= 2
+	}
+	if delay <= 0 || delay > max {
+		return max
+	}
+	return delay
+}
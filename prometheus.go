@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gocraft/health"
+)
+
+// prometheusNamespace prefixes every exported metric name
+const prometheusNamespace = "corsproxy"
+
+// prometheusMaxJobs bounds the job_name label values of jobs_total. Jobs are named
+// after route templates rather than URLs, and this guards against anything
+// naming jobs after unbounded input. Further jobs are counted as
+// prometheusOtherJob.
+const prometheusMaxJobs = 256
+
+// prometheusOtherJob is the job_name label of jobs over prometheusMaxJobs
+const prometheusOtherJob = "other"
+
+// prometheusBuckets are the upper bounds, in seconds, of the timing histograms
+var prometheusBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15}
+
+// prometheusSink is a health.Sink that aggregates jobs, events, errors,
+// timings and gauges into metrics in the Prometheus text exposition format
+type prometheusSink struct {
+	mu          sync.Mutex
+	completions map[jobStatusKey]uint64
+	jobs        map[string]bool
+	events      map[string]uint64
+	errors      map[string]uint64
+	timings     map[string]*histogram
+	gauges      map[string]float64
+}
+
+// jobStatusKey identifies a job completion counter
+type jobStatusKey struct {
+	job    string
+	status string
+}
+
+// histogram is a cumulative Prometheus histogram
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe adds a value, in seconds, to the histogram
+func (h *histogram) observe(v float64) {
+	for i, bound := range prometheusBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// newPrometheusSink creates an empty prometheusSink
+func newPrometheusSink() *prometheusSink {
+	return &prometheusSink{
+		completions: map[jobStatusKey]uint64{},
+		jobs:        map[string]bool{},
+		events:      map[string]uint64{},
+		errors:      map[string]uint64{},
+		timings:     map[string]*histogram{},
+		gauges:      map[string]float64{},
+	}
+}
+
+// EmitEvent counts the event
+func (s *prometheusSink) EmitEvent(job string, event string, kvs map[string]string) {
+	s.mu.Lock()
+	s.events[event]++
+	s.mu.Unlock()
+}
+
+// EmitEventErr counts the error by event name
+func (s *prometheusSink) EmitEventErr(job string, event string, inputErr error, kvs map[string]string) {
+	s.mu.Lock()
+	s.errors[event]++
+	s.mu.Unlock()
+}
+
+// EmitTiming adds the timing to the event's histogram
+func (s *prometheusSink) EmitTiming(job string, event string, nanoseconds int64, kvs map[string]string) {
+	s.mu.Lock()
+	h, ok := s.timings[event]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(prometheusBuckets))}
+		s.timings[event] = h
+	}
+	h.observe(float64(nanoseconds) / 1e9)
+	s.mu.Unlock()
+}
+
+// EmitGauge records the latest value of the gauge
+func (s *prometheusSink) EmitGauge(job string, event string, value float64, kvs map[string]string) {
+	s.mu.Lock()
+	s.gauges[event] = value
+	s.mu.Unlock()
+}
+
+// EmitComplete counts the job completion by status
+func (s *prometheusSink) EmitComplete(job string, status health.CompletionStatus, nanoseconds int64, kvs map[string]string) {
+	s.mu.Lock()
+	if !s.jobs[job] {
+		if len(s.jobs) < prometheusMaxJobs {
+			s.jobs[job] = true
+		} else {
+			job = prometheusOtherJob
+		}
+	}
+	s.completions[jobStatusKey{job: job, status: status.String()}]++
+	s.mu.Unlock()
+}
+
+// WriteMetrics writes every metric in the Prometheus text exposition format,
+// along with the number of nodes per state read from db
+func (s *prometheusSink) WriteMetrics(b *bytes.Buffer, db *sql.DB) error {
+	// Read node states before locking so a slow database doesn't block sinks
+	nodesPerState := map[string]int{}
+	states, err := listCurrentNodeStates(db)
+	if err != nil {
+		return err
+	}
+	for _, st := range states {
+		nodesPerState[st.State]++
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeMetricHeader(b, "jobs_total", "counter", "Completed jobs by name and completion status.")
+	keys := make([]jobStatusKey, 0, len(s.completions))
+	for k := range s.completions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].job != keys[j].job {
+			return keys[i].job < keys[j].job
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		writeMetric(b, "jobs_total", labels("job_name", k.job, "status", k.status), float64(s.completions[k]))
+	}
+
+	writeMetricHeader(b, "events_total", "counter", "Emitted events by name.")
+	for _, event := range sortedKeys(s.events) {
+		writeMetric(b, "events_total", labels("event", event), float64(s.events[event]))
+	}
+
+	writeMetricHeader(b, "errors_total", "counter", "Emitted errors by event name.")
+	for _, event := range sortedKeys(s.errors) {
+		writeMetric(b, "errors_total", labels("event", event), float64(s.errors[event]))
+	}
+
+	writeMetricHeader(b, "timing_seconds", "histogram", "Timings, such as upstream latency, by event name.")
+	timingEvents := make([]string, 0, len(s.timings))
+	for event := range s.timings {
+		timingEvents = append(timingEvents, event)
+	}
+	sort.Strings(timingEvents)
+	for _, event := range timingEvents {
+		h := s.timings[event]
+		for i, bound := range prometheusBuckets {
+			writeMetric(b, "timing_seconds_bucket", labels("event", event, "le", formatFloat(bound)), float64(h.counts[i]))
+		}
+		writeMetric(b, "timing_seconds_bucket", labels("event", event, "le", "+Inf"), float64(h.count))
+		writeMetric(b, "timing_seconds_sum", labels("event", event), h.sum)
+		writeMetric(b, "timing_seconds_count", labels("event", event), float64(h.count))
+	}
+
+	writeMetricHeader(b, "gauge", "gauge", "Latest value of emitted gauges by event name.")
+	gaugeEvents := make([]string, 0, len(s.gauges))
+	for event := range s.gauges {
+		gaugeEvents = append(gaugeEvents, event)
+	}
+	sort.Strings(gaugeEvents)
+	for _, event := range gaugeEvents {
+		writeMetric(b, "gauge", labels("event", event), s.gauges[event])
+	}
+
+	writeMetricHeader(b, "nodes", "gauge", "Registered nodes by current state.")
+	stateNames := make([]string, 0, len(nodesPerState))
+	for state := range nodesPerState {
+		stateNames = append(stateNames, state)
+	}
+	sort.Strings(stateNames)
+	for _, state := range stateNames {
+		writeMetric(b, "nodes", labels("state", state), float64(nodesPerState[state]))
+	}
+
+	return nil
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric
+func writeMetricHeader(b *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s_%s %s\n", prometheusNamespace, name, help)
+	fmt.Fprintf(b, "# TYPE %s_%s %s\n", prometheusNamespace, name, kind)
+}
+
+// writeMetric writes a single sample
+func writeMetric(b *bytes.Buffer, name string, labels string, value float64) {
+	fmt.Fprintf(b, "%s_%s%s %s\n", prometheusNamespace, name, labels, formatFloat(value))
+}
+
+// labels formats alternating label names and values as a label set
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+escapeLabelValue(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// labelValueEscaper escapes label values per the text exposition format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes a label value
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// formatFloat formats a sample value
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/health"
+	"github.com/gocraft/web"
+)
+
+// anyRoute is the rate limit route matching routes without a limit of their own
+const anyRoute = "*"
+
+// unlimitedRoutes are the probe endpoints of load balancers and supervisors,
+// which are never rate limited: busy clients mustn't get an instance pulled
+// out of rotation
+var unlimitedRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// rateLimit allows Requests every Per, in bursts of up to Burst requests
+type rateLimit struct {
+	Requests int      `json:"requests"`
+	Per      Duration `json:"per"`
+	Burst    int      `json:"burst"`
+}
+
+// String formats the limit as requests/per:burst, such as 10/s:20, or "" if
+// the limit isn't set
+func (l rateLimit) String() string {
+	if !l.enabled() {
+		return ""
+	}
+	per := time.Duration(l.Per).String()
+	switch time.Duration(l.Per) {
+	case time.Second:
+		per = "s"
+	case time.Minute:
+		per = "m"
+	case time.Hour:
+		per = "h"
+	}
+	return fmt.Sprintf("%d/%s:%d", l.Requests, per, l.Burst)
+}
+
+// Set parses a limit formatted as requests/per:burst, or clears it if s is
+// empty
+func (l *rateLimit) Set(s string) error {
+	if strings.TrimSpace(s) == "" {
+		*l = rateLimit{}
+		return nil
+	}
+	limit, err := parseRateLimit(s)
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// enabled reports whether the limit is set
+func (l rateLimit) enabled() bool {
+	return l != rateLimit{}
+}
+
+// rate returns the requests allowed per second
+func (l rateLimit) rate() float64 {
+	return float64(l.Requests) / time.Duration(l.Per).Seconds()
+}
+
+// validate checks the limit can allow requests
+func (l rateLimit) validate() error {
+	if l.Requests <= 0 || l.Per <= 0 || l.Burst <= 0 {
+		return errors.New("Requests, per and burst of a rate limit must be positive")
+	}
+	return nil
+}
+
+// parseRateLimits parses a comma separated list of route=requests/per:burst
+// limits, such as /status/:ip=10/s:20,*=100/m:50
+func parseRateLimits(s string) (map[string]rateLimit, error) {
+	limits := map[string]rateLimit{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid rate limit: %q", pair)
+		}
+		route, spec := pair[:i], pair[i+1:]
+
+		limit, err := parseRateLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rate limit for %s: %s", route, err)
+		}
+		limits[route] = limit
+	}
+	return limits, nil
+}
+
+// parseRateLimit parses a limit formatted as requests/per:burst. per is a
+// duration or one of s, m and h.
+func parseRateLimit(s string) (rateLimit, error) {
+	var limit rateLimit
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	rate := strings.SplitN(parts[0], "/", 2)
+	if len(parts) != 2 || len(rate) != 2 {
+		return limit, fmt.Errorf("%q isn't formatted as requests/per:burst", s)
+	}
+
+	var err error
+	limit.Requests, err = strconv.Atoi(rate[0])
+	if err != nil {
+		return limit, fmt.Errorf("Invalid requests in %q", s)
+	}
+	per := rate[1]
+	if per == "s" || per == "m" || per == "h" {
+		per = "1" + per
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil {
+		return limit, fmt.Errorf("Invalid period in %q", s)
+	}
+	limit.Per = Duration(d)
+	limit.Burst, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return limit, fmt.Errorf("Invalid burst in %q", s)
+	}
+
+	return limit, limit.validate()
+}
+
+// rateLimitFor returns the limit of the route, if it has one
+func (s *liveSettings) rateLimitFor(route string) (rateLimit, bool) {
+	if unlimitedRoutes[route] {
+		return rateLimit{}, false
+	}
+	limit, ok := s.rateLimits[route]
+	if !ok {
+		limit, ok = s.rateLimits[anyRoute]
+	}
+	return limit, ok
+}
+
+// clientIP returns the address of the client that made r. Forwarding headers
+// are only believed from trusted proxies: the client is the nearest address
+// in the chain that isn't a trusted proxy. Requests over a Unix socket come
+// from a local proxy and are trusted.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if ip := net.ParseIP(remote); ip != nil && !containsIP(trusted, ip) {
+		return remote
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil || !containsIP(trusted, ip) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return remote
+}
+
+// forwardedFor returns the client addresses from the Forwarded header, or
+// from X-Forwarded-For if there's no Forwarded header, in the order the
+// proxies added them
+func forwardedFor(h http.Header) []string {
+	hops := []string{}
+	if forwarded := h.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, stripPort(strings.Trim(kv[1], `"`)))
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, list := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(list, ",") {
+			hop = strings.TrimSpace(hop)
+			if hop != "" {
+				hops = append(hops, stripPort(hop))
+			}
+		}
+	}
+	return hops
+}
+
+// stripPort removes the port and IPv6 brackets from a forwarded address
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// containsIP reports whether any of the networks contains ip
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenBucket is the rate limit state of a client on a route
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitResult is the outcome of taking a token
+type rateLimitResult struct {
+	allowed   bool
+	remaining int
+
+	// reset is the time until the bucket is full again and retryAfter the
+	// time until a request is allowed again
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// rateLimiter holds a token bucket per key. Memory is bounded by keeping at
+// most maxBuckets buckets, evicting the least recently used, and by dropping
+// buckets idle for idleTimeout.
+type rateLimiter struct {
+	maxBuckets  int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+
+	// lru orders the buckets from most to least recently used
+	lru *list.List
+}
+
+// newRateLimiter creates a rateLimiter
+func newRateLimiter(maxBuckets int, idleTimeout time.Duration) *rateLimiter {
+	return &rateLimiter{
+		maxBuckets:  maxBuckets,
+		idleTimeout: idleTimeout,
+		buckets:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+}
+
+// take takes a token from the bucket of key, which refills at limit. New
+// buckets start full.
+func (l *rateLimiter) take(key string, limit rateLimit, now time.Time) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := limit.rate()
+	burst := float64(limit.Burst)
+
+	var b *tokenBucket
+	if e, ok := l.buckets[key]; ok {
+		b = e.Value.(*tokenBucket)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		l.lru.MoveToFront(e)
+	} else {
+		b = &tokenBucket{key: key, tokens: burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	l.evict(now)
+
+	result := rateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.allowed = true
+	} else {
+		result.retryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	result.remaining = int(b.tokens)
+	result.reset = time.Duration((burst - b.tokens) / rate * float64(time.Second))
+	return result
+}
+
+// refund returns a token taken from the bucket of key, for a request that
+// wasn't made after all
+func (l *rateLimiter) refund(key string, limit rateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.buckets[key]; ok {
+		b := e.Value.(*tokenBucket)
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+1)
+	}
+}
+
+// evict drops idle buckets and the least recently used ones over the limit
+func (l *rateLimiter) evict(now time.Time) {
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		b := e.Value.(*tokenBucket)
+		if l.lru.Len() <= l.maxBuckets && now.Sub(b.last) < l.idleTimeout {
+			return
+		}
+		l.lru.Remove(e)
+		delete(l.buckets, b.key)
+	}
+}
+
+// newRateLimitMiddleware returns a middleware that limits the requests each
+// client makes to each route, answering 429 Too Many Requests once the
+// client's bucket is empty. It has to run once the request is routed.
+func newRateLimitMiddleware(limiter *rateLimiter) middlewareFunc {
+	return func(c *Context, rw web.ResponseWriter, r *web.Request, next web.NextMiddlewareFunc) {
+		s := currentSettings()
+		route := r.RoutePath()
+		limit, ok := s.rateLimitFor(route)
+		if !ok {
+			next(rw, r)
+			return
+		}
+
+		client := clientIP(r.Request, s.trustedProxies)
+		result := limiter.take(route+" "+client, limit, time.Now())
+		rw.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		rw.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+		rw.Header().Set("RateLimit-Reset", ceilSeconds(result.reset))
+		rw.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", limit.Requests, ceilSeconds(time.Duration(limit.Per))))
+		if !result.allowed {
+			rw.Header().Set("Retry-After", ceilSeconds(result.retryAfter))
+			c.job.EventKv("ratelimit.limited", health.Kvs{"client": client, "route": route})
+			writeJSONStatus(c, rw, http.StatusTooManyRequests, map[string]string{"error": "Too many requests"})
+			return
+		}
+		next(rw, r)
+	}
+}
+
+// ceilSeconds formats d as whole seconds, rounded up
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
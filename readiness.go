@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocraft/health"
+	"github.com/gocraft/web"
+)
+
+// Readiness check statuses
+const (
+	checkStatusOK   = "ok"
+	checkStatusFail = "fail"
+)
+
+// Errors reported by failed readiness checks
+var (
+	errShuttingDown        = errors.New("Server is shutting down")
+	errWriteQueueSaturated = errors.New("Database write queue is saturated")
+	errSinkSaturated       = errors.New("Health sink is dropping emissions")
+)
+
+// checkResult is the outcome of a single readiness check
+type checkResult struct {
+	Name      string                 `json:"name"`
+	Status    string                 `json:"status"`
+	LatencyMs float64                `json:"latency_ms"`
+	Error     string                 `json:"error,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// ReadinessResponse represents the response from the readiness endpoint
+type ReadinessResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// readinessChecker decides whether the proxy should receive traffic
+type readinessChecker struct {
+	db             *sql.DB
+	sinks          *sinkSet
+	timeout        time.Duration
+	maxWriteWait   time.Duration
+	sampleInterval time.Duration
+
+	shuttingDown int32
+
+	// Pool and sink counters as of the previous sample, so saturation is
+	// judged on recent activity rather than all time. Samples are taken on
+	// a ticker rather than per check, so several probers don't reset each
+	// other's baselines.
+	mu               sync.Mutex
+	lastWaitCount    int64
+	lastWaitDuration time.Duration
+	lastDropped      map[string]uint64
+	writeQueue       saturationSample
+	sinkSaturation   saturationSample
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// saturationSample is the outcome of a saturation check over a sample interval
+type saturationSample struct {
+	details map[string]interface{}
+	err     error
+}
+
+// newReadinessChecker creates a readinessChecker. Each check gives up after
+// timeout and the write queue is saturated once writers wait on average longer
+// than maxWriteWait for the database over a sampleInterval.
+func newReadinessChecker(db *sql.DB, sinks *sinkSet, timeout time.Duration, maxWriteWait time.Duration, sampleInterval time.Duration) *readinessChecker {
+	rc := &readinessChecker{
+		db:             db,
+		sinks:          sinks,
+		timeout:        timeout,
+		maxWriteWait:   maxWriteWait,
+		sampleInterval: sampleInterval,
+		lastDropped:    map[string]uint64{},
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	rc.sample()
+	return rc
+}
+
+// Start begins sampling the pool and sink counters in the background
+func (rc *readinessChecker) Start() {
+	go rc.loop()
+}
+
+// Stop stops sampling and waits for the sampler to finish
+func (rc *readinessChecker) Stop() {
+	close(rc.stop)
+	<-rc.done
+}
+
+func (rc *readinessChecker) loop() {
+	defer close(rc.done)
+
+	ticker := time.NewTicker(rc.sampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rc.stop:
+			return
+		case <-ticker.C:
+			rc.sample()
+		}
+	}
+}
+
+// sample judges the write queue and sinks on their counters' change since
+// the previous sample
+func (rc *readinessChecker) sample() {
+	writeQueue := rc.sampleWriteQueue()
+	sinkSaturation := rc.sampleSinks()
+
+	rc.mu.Lock()
+	rc.writeQueue = writeQueue
+	rc.sinkSaturation = sinkSaturation
+	rc.mu.Unlock()
+}
+
+// Shutdown fails every following readiness check so load balancers stop
+// sending traffic while the server drains
+func (rc *readinessChecker) Shutdown() {
+	atomic.StoreInt32(&rc.shuttingDown, 1)
+}
+
+// ShuttingDown reports whether Shutdown was called
+func (rc *readinessChecker) ShuttingDown() bool {
+	return atomic.LoadInt32(&rc.shuttingDown) == 1
+}
+
+// Check runs every readiness check and reports whether all of them passed
+func (rc *readinessChecker) Check(ctx context.Context) (bool, []checkResult) {
+	checks := []struct {
+		name string
+		fn   func(context.Context) (map[string]interface{}, error)
+	}{
+		{"shutdown", rc.checkShutdown},
+		{"database", rc.checkDatabase},
+		{"write_queue", rc.checkWriteQueue},
+		{"sinks", rc.checkSinks},
+	}
+
+	ready := true
+	results := make([]checkResult, 0, len(checks))
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, rc.timeout)
+		start := time.Now()
+		details, err := check.fn(checkCtx)
+		cancel()
+
+		result := checkResult{
+			Name:      check.name,
+			Status:    checkStatusOK,
+			LatencyMs: durationMs(time.Since(start)),
+			Details:   details,
+		}
+		if err != nil {
+			ready = false
+			result.Status = checkStatusFail
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	return ready, results
+}
+
+// checkShutdown fails once the server is shutting down
+func (rc *readinessChecker) checkShutdown(ctx context.Context) (map[string]interface{}, error) {
+	if rc.ShuttingDown() {
+		return nil, errShuttingDown
+	}
+	return nil, nil
+}
+
+// checkDatabase takes the sqlite write lock and rolls back, which fails if the
+// database is read-only, locked for too long or gone
+func (rc *readinessChecker) checkDatabase(ctx context.Context) (map[string]interface{}, error) {
+	tx, err := rc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Write statements take the write lock even if they change no rows
+	_, err = tx.ExecContext(ctx, "DELETE FROM nodes WHERE 0")
+	return nil, err
+}
+
+// checkWriteQueue fails if writers waited too long on average for the single
+// sqlite connection over the latest sample interval
+func (rc *readinessChecker) checkWriteQueue(ctx context.Context) (map[string]interface{}, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.writeQueue.details, rc.writeQueue.err
+}
+
+// checkSinks fails if any health sink's buffer was full or it dropped
+// emissions over the latest sample interval
+func (rc *readinessChecker) checkSinks(ctx context.Context) (map[string]interface{}, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.sinkSaturation.details, rc.sinkSaturation.err
+}
+
+// sampleWriteQueue computes the average wait for the database connection
+// since the previous sample
+func (rc *readinessChecker) sampleWriteQueue() saturationSample {
+	stats := rc.db.Stats()
+
+	rc.mu.Lock()
+	waits := stats.WaitCount - rc.lastWaitCount
+	waited := stats.WaitDuration - rc.lastWaitDuration
+	rc.lastWaitCount = stats.WaitCount
+	rc.lastWaitDuration = stats.WaitDuration
+	rc.mu.Unlock()
+
+	var avgWait time.Duration
+	if waits > 0 {
+		avgWait = waited / time.Duration(waits)
+	}
+	details := map[string]interface{}{
+		"in_use":      stats.InUse,
+		"waits":       waits,
+		"avg_wait_ms": durationMs(avgWait),
+	}
+	if avgWait > rc.maxWriteWait {
+		return saturationSample{details, errWriteQueueSaturated}
+	}
+	return saturationSample{details, nil}
+}
+
+// sampleSinks checks whether any health sink's buffer is full or it dropped
+// emissions since the previous sample
+func (rc *readinessChecker) sampleSinks() saturationSample {
+	details := map[string]interface{}{}
+	var err error
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, s := range rc.sinks.sinks {
+		backlog, size := s.Backlog()
+		dropped := s.Dropped()
+		details[s.name] = map[string]interface{}{
+			"backlog": backlog,
+			"size":    size,
+			"dropped": dropped,
+		}
+		if backlog >= size || dropped > rc.lastDropped[s.name] {
+			err = errSinkSaturated
+		}
+		rc.lastDropped[s.name] = dropped
+	}
+
+	return saturationSample{details, err}
+}
+
+// newLivenessHandler returns a handler that reports the process is up. It
+// checks no dependencies so a supervisor only restarts a wedged process.
+func newLivenessHandler() handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		writeJSON(c, rw, map[string]string{"status": checkStatusOK})
+	}
+}
+
+// newReadinessHandler returns a handler that runs the readiness checks and
+// responds 503 if any of them failed
+func newReadinessHandler(checker *readinessChecker) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, req *web.Request) {
+		ready, results := checker.Check(req.Context())
+
+		response := &ReadinessResponse{Status: checkStatusOK, Checks: results}
+		status := http.StatusOK
+		if !ready {
+			response.Status = checkStatusFail
+			status = http.StatusServiceUnavailable
+			for _, result := range results {
+				if result.Status == checkStatusFail {
+					c.job.EventKv("readiness.fail", health.Kvs{"check": result.Name, "error": result.Error})
+				}
+			}
+		}
+
+		writeJSONStatus(c, rw, status, response)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// errTargetNotAllowed is returned for targets rejected by the allow/deny lists
+var errTargetNotAllowed = errors.New("Target is not allowed")
+
+// liveSettings are the settings that can change without a restart. They're
+// replaced as a whole on reload so readers always see a consistent set.
+type liveSettings struct {
+	// corsOrigins are the allowed CORS origins, or nil if any is allowed
+	corsOrigins map[string]bool
+
+	// targetAllow, if not empty, limits targets to these networks and
+	// targetDeny rejects targets in these networks
+	targetAllow []*net.IPNet
+	targetDeny  []*net.IPNet
+
+	// targetTokens verifies the tokens permitting status requests
+	targetTokens *targetTokenVerifier
+
+	upstreamTimeout time.Duration
+
+	// rateLimits are the limits of incoming requests by route, and
+	// trustedProxies the proxies believed about the client's address
+	rateLimits     map[string]rateLimit
+	trustedProxies []*net.IPNet
+
+	// outboundPerTarget limits the requests made to each relay and
+	// outboundGlobal those made to all relays together
+	outboundPerTarget rateLimit
+	outboundGlobal    rateLimit
+
+	// anonymousScopes are granted to requests without an API key
+	anonymousScopes []string
+}
+
+// settings holds the current *liveSettings
+var settings atomic.Value
+
+func init() {
+	settings.Store(&liveSettings{upstreamTimeout: HTTPTimeout})
+}
+
+// currentSettings returns the settings in effect
+func currentSettings() *liveSettings {
+	return settings.Load().(*liveSettings)
+}
+
+// newLiveSettings creates the live settings from the config
+func newLiveSettings(cfg *Config) (*liveSettings, error) {
+	s := &liveSettings{
+		upstreamTimeout: time.Duration(cfg.Upstream.Timeout),
+		rateLimits:      cfg.RateLimit.Routes,
+
+		outboundPerTarget: cfg.Outbound.PerTarget,
+		outboundGlobal:    cfg.Outbound.Global,
+	}
+
+	for _, origin := range cfg.CORS.AllowedOrigins {
+		if origin == "*" {
+			s.corsOrigins = nil
+			break
+		}
+		if s.corsOrigins == nil {
+			s.corsOrigins = map[string]bool{}
+		}
+		s.corsOrigins[origin] = true
+	}
+
+	var err error
+	s.targetAllow, err = parseNetworks(cfg.Targets.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("targets.allow: %s", err)
+	}
+	s.targetDeny, err = parseNetworks(cfg.Targets.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("targets.deny: %s", err)
+	}
+	s.targetTokens, err = newTargetTokenVerifier(cfg.TargetTokens)
+	if err != nil {
+		return nil, fmt.Errorf("target_tokens: %s", err)
+	}
+	s.trustedProxies, err = parseNetworks(cfg.RateLimit.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("rate_limit.trusted_proxies: %s", err)
+	}
+	s.anonymousScopes, err = parseAnonymousScopes(cfg.Auth.AnonymousScopes.String())
+	if err != nil {
+		return nil, fmt.Errorf("auth.anonymous_scopes: %s", err)
+	}
+
+	return s, nil
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or "" if the origin isn't allowed
+func (s *liveSettings) allowOrigin(origin string) string {
+	if s.corsOrigins == nil {
+		return accessControlAllowOriginHeader
+	}
+	if s.corsOrigins[origin] {
+		return origin
+	}
+	return ""
+}
+
+// allowTarget reports whether requests may be made to the node at ip
+func (s *liveSettings) allowTarget(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return len(s.targetAllow) == 0 && len(s.targetDeny) == 0
+	}
+	for _, n := range s.targetDeny {
+		if n.Contains(addr) {
+			return false
+		}
+	}
+	if len(s.targetAllow) == 0 {
+		return true
+	}
+	for _, n := range s.targetAllow {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses a list of CIDRs and ips, the latter as single address
+// networks
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid ip or CIDR: %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ip or CIDR: %q", s)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// configReloader reloads the reloadable settings from the same file,
+// environment and flags the server was started with, on SIGHUP or request
+type configReloader struct {
+	args     []string
+	webhooks *webhookDispatcher
+
+	// started is the config the server was started with and cfg the one
+	// live settings were last loaded from
+	started *Config
+	mu      sync.Mutex
+	cfg     *Config
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// reloadResult describes the outcome of a reload
+type reloadResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Changed lists the applied changes and RestartRequired the changed
+	// settings that only take effect on restart
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// newConfigReloader creates a configReloader for a server started with cfg
+// loaded from args, and applies cfg's live settings
+func newConfigReloader(args []string, cfg *Config, webhooks *webhookDispatcher) (*configReloader, error) {
+	s, err := newLiveSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	settings.Store(s)
+
+	return &configReloader{
+		args:     args,
+		webhooks: webhooks,
+		started:  cfg,
+		cfg:      cfg,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start begins listening for SIGHUP in the background
+func (r *configReloader) Start() {
+	go r.loop()
+}
+
+// Stop stops listening for SIGHUP and waits for a running reload
+func (r *configReloader) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *configReloader) loop() {
+	defer close(r.done)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-hup:
+			r.Reload("sighup")
+		}
+	}
+}
+
+// Reload loads the config again and applies the changed reloadable settings.
+// Nothing is applied if the new config is invalid.
+func (r *configReloader) Reload(trigger string) *reloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := stream.NewJob("config.reload")
+	job.KeyValue("trigger", trigger)
+	result := &reloadResult{Changed: []string{}, RestartRequired: []string{}}
+
+	// Validate everything before applying anything
+	cfg, err := loadConfig(r.args)
+	var s *liveSettings
+	if err == nil {
+		s, err = newLiveSettings(cfg)
+	}
+	if err != nil {
+		job.EventErr("config.reload.invalid", err)
+		job.Complete(health.Error)
+		result.Status = "rolled_back"
+		result.Error = err.Error()
+		return result
+	}
+
+	for _, change := range diffConfigs(r.cfg.Redacted(), cfg.Redacted()) {
+		if change.reloadable {
+			result.Changed = append(result.Changed, change.String())
+		}
+	}
+	for _, change := range diffConfigs(r.started.Redacted(), cfg.Redacted()) {
+		if !change.reloadable {
+			result.RestartRequired = append(result.RestartRequired, change.path)
+		}
+	}
+
+	settings.Store(s)
+	r.webhooks.SetSubscriptions(cfg.Webhooks.Subscriptions)
+	r.cfg = cfg
+
+	if len(result.RestartRequired) > 0 {
+		job.EventKv("config.reload.restart_required", health.Kvs{"settings": strings.Join(result.RestartRequired, ",")})
+	}
+	job.EventKv("config.reload.applied", health.Kvs{"changed": strings.Join(result.Changed, "; ")})
+	job.Complete(health.Success)
+	result.Status = "applied"
+	return result
+}
+
+// configChange is a setting that differs between two configs
+type configChange struct {
+	path       string
+	from       string
+	to         string
+	reloadable bool
+}
+
+// String formats the change as path: from -> to
+func (c configChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.path, emptyAsQuotes(c.from), emptyAsQuotes(c.to))
+}
+
+// emptyAsQuotes returns s, or "" in quotes if it's empty
+func emptyAsQuotes(s string) string {
+	if s == "" {
+		return `""`
+	}
+	return s
+}
+
+// diffConfigs returns the settings that differ between two configs
+func diffConfigs(from *Config, to *Config) []configChange {
+	changes := []configChange{}
+	toFields := to.fields()
+	for i, f := range from.fields() {
+		before := fmt.Sprint(f.value.Interface())
+		after := fmt.Sprint(toFields[i].value.Interface())
+		if before == after {
+			continue
+		}
+		changes = append(changes, configChange{path: f.path, from: before, to: after, reloadable: f.reloadable})
+	}
+	return changes
+}
+
+// newReloadHandler returns a handler that reloads the config on POST
+func newReloadHandler(reloader *configReloader) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		result := reloader.Reload("admin")
+		status := http.StatusOK
+		if result.Error != "" {
+			status = http.StatusUnprocessableEntity
+		}
+		writeAdminJSON(rw, status, result)
+	})
+}
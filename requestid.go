@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// requestIDHeader carries the request ID from the browser, to the relay and
+// back in the response
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the length of incoming request IDs we reuse
+const maxRequestIDLength = 128
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// newRequestID returns a random 128 bit request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an incoming request ID is safe to reuse in
+// headers and logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID returns a copy of ctx carrying the request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID carried by ctx or ""
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
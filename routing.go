@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"time"
 
 	"github.com/gocraft/health"
 	"github.com/gocraft/web"
@@ -13,16 +18,41 @@ import (
 
 // CORS headers
 const accessControlAllowOriginHeader = "*"
-const accessControlAllowHeadersHeader = "Origin, X-Requested-With, Content-Type, Accept"
+const accessControlAllowHeadersHeader = "Origin, X-Requested-With, Content-Type, Accept, " + requestIDHeader + ", " + traceparentHeader + ", " + targetTokenHeader
+const accessControlExposeHeadersHeader = requestIDHeader + ", RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After, Age, Cache-Status"
+
+// notFoundJobName is the job name of requests that don't match a route
+const notFoundJobName = "not_found"
+
+// relayPort is the port ob-relay serves its status endpoint on
+const relayPort = "8080"
+
+// statusRoutePath is the route proxied to ob-relay status endpoints
+const statusRoutePath = "/status/:ip"
 
 // middlewareFunc is a gocraft/web compatible middleware
 type middlewareFunc func(c *Context, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc)
 
+// handlerFunc is a gocraft/web compatible handler
+type handlerFunc func(c *Context, rw web.ResponseWriter, req *web.Request)
+
 // Context is the context for incoming HTTP requests
 type Context struct {
 	job        *health.Job
 	err        error
+	requestID  string
 	nodeStatus string
+	probeErr   error
+
+	// probed is set once the handler has requested the node's status, so
+	// the outcome is persisted
+	probed bool
+
+	// cacheStatus describes how a cache served the request, if one did
+	cacheStatus string
+
+	// principal is who made the request, set by the auth middleware
+	principal *principal
 }
 
 // StatusResponse represents the response from the ob-relay status endpoint
@@ -30,74 +60,172 @@ type StatusResponse struct {
 	Status string `json:"status"`
 }
 
-func newRouter(UpdateNodeStateMiddleware middlewareFunc) *web.Router {
-	return web.New(Context{}).
+// newRouter creates the router of the public listener. It only serves the
+// status proxy and the probes of load balancers and supervisors: the
+// management API is served by newAdminRouter on the admin listener.
+func newRouter(UpdateNodeStateMiddleware middlewareFunc, rateLimitMiddleware middlewareFunc, db *sql.DB, outbound *outboundLimiter, readiness *readinessChecker) *web.Router {
+	router := web.New(Context{}).
 		Middleware((*Context).HealthCheck).
 		Middleware(web.LoggerMiddleware).
 		Middleware(web.ShowErrorsMiddleware).
 		Middleware((*Context).AddCORSHeaders).
-		Middleware(UpdateNodeStateMiddleware).
-		Get("/status/:ip", (*Context).StatusRequestProxyHandler)
+		Middleware(UpdateNodeStateMiddleware)
+
+	// Routes live on a subrouter sharing the root context, so its middleware
+	// runs once the request has been routed
+	router.Subrouter(Context{}, "").
+		Middleware((*Context).NameJob).
+		Middleware(rateLimitMiddleware).
+		Get(statusRoutePath, newStatusRequestProxyHandler(db, outbound)).
+		Get("/healthz", newLivenessHandler()).
+		Get("/readyz", newReadinessHandler(readiness))
+
+	return router
 }
 
-// AddCORSHeaders sets the proper HTTP response headers for a CORS request
+// AddCORSHeaders sets the proper HTTP response headers for a CORS request.
+// Requests from origins that aren't allowed get no Access-Control-Allow-Origin
+// header, so browsers don't expose the response.
 func (*Context) AddCORSHeaders(rw web.ResponseWriter, r *web.Request, next web.NextMiddlewareFunc) {
-	rw.Header().Set("Access-Control-Allow-Origin", accessControlAllowOriginHeader)
+	allowOrigin := currentSettings().allowOrigin(r.Header.Get("Origin"))
+	if allowOrigin != accessControlAllowOriginHeader {
+		rw.Header().Add("Vary", "Origin")
+	}
+	if allowOrigin != "" {
+		rw.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+	}
 	rw.Header().Set("Access-Control-Allow-Headers", accessControlAllowHeadersHeader)
+	rw.Header().Set("Access-Control-Expose-Headers", accessControlExposeHeadersHeader)
 	next(rw, r)
 }
 
-// HealthCheck
+// HealthCheck instruments the request with a health job and writes errors set
+// on the context to the response. The job is named notFoundJobName until
+// NameJob names it after the matched route.
 func (c *Context) HealthCheck(rw web.ResponseWriter, r *web.Request, next web.NextMiddlewareFunc) {
+	// Reuse a valid incoming request ID or create one
+	c.requestID = r.Header.Get(requestIDHeader)
+	if !validRequestID(c.requestID) {
+		c.requestID = newRequestID()
+	}
+	r.Request = r.Request.WithContext(withRequestID(r.Context(), c.requestID))
+	rw.Header().Set(requestIDHeader, c.requestID)
+
+	// Continue the caller's trace, if any
+	ctx, span := tracer.StartServerSpan(r.Context(), notFoundJobName, r.Header)
+	r.Request = r.Request.WithContext(ctx)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("request_id", c.requestID)
+	defer span.Finish()
+
 	// Setup instrumentation
-	c.job = stream.NewJob(r.URL.String())
+	c.job = stream.NewJob(notFoundJobName)
+	c.job.KeyValue("request_id", c.requestID)
+	c.job.KeyValue("trace_id", hex.EncodeToString(span.TraceID[:]))
+	if origin := r.Header.Get("Origin"); origin != "" {
+		c.job.KeyValue("origin", origin)
+	}
 
 	// Execute the request
 	next(rw, r)
 
-	// We're done if no errors
+	span.SetName(c.job.JobName)
+	if r.IsRouted() {
+		span.SetAttribute("http.route", r.RoutePath())
+	}
+	if c.cacheStatus != "" {
+		c.job.KeyValue("cache", c.cacheStatus)
+	}
+
+	// We're done if no errors, completing the job by the response's status
 	if c.err == nil {
-		c.job.Complete(health.Success)
+		status := rw.StatusCode()
+		span.SetAttribute("http.status_code", status)
+		switch {
+		case status >= http.StatusInternalServerError:
+			c.job.Complete(health.Error)
+		case status >= http.StatusBadRequest:
+			c.job.Complete(health.ValidationError)
+		default:
+			c.job.Complete(health.Success)
+		}
 		return
 	}
 
 	// Otherwise return the errors to the caller
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintf(rw, `{"error":%q}`, c.err)
+	fmt.Fprintf(rw, `{"error":%q,"request_id":%q}`, c.err, c.requestID)
+	span.SetAttribute("http.status_code", http.StatusInternalServerError)
+	span.SetError(c.err)
+	c.job.KeyValue("error_class", errorClass(c.err))
 	c.job.Complete(health.Error)
 }
 
-// StatusRequestProxyHandler gets a status from ob-relay
-func (c *Context) StatusRequestProxyHandler(rw web.ResponseWriter, r *web.Request) {
-	url := "https://" + r.PathParams["ip"] + ":8080/status"
+// NameJob names the request's job after the matched route template, such as
+// "GET /status/:ip", so job names stay low-cardinality. The target ip is
+// attached as a key value instead.
+func (c *Context) NameJob(rw web.ResponseWriter, r *web.Request, next web.NextMiddlewareFunc) {
+	c.job.JobName = r.Method + " " + r.RoutePath()
+	if ip := r.PathParams["ip"]; ip != "" {
+		c.job.KeyValue("ip", ip)
+	}
+	next(rw, r)
+}
 
-	// Perform the request
-	resp, err := HTTPClient.Get(url)
-	if err != nil {
-		c.err = err
-		c.job.EventErr("proxy.request_url", c.err)
-		return
+// newStatusRequestProxyHandler returns a handler that gets a status from
+// ob-relay. Once the outbound limits for the relay are reached, the last known
+// state is served instead.
+func newStatusRequestProxyHandler(db *sql.DB, outbound *outboundLimiter) handlerFunc {
+	return func(c *Context, rw web.ResponseWriter, r *web.Request) {
+		c.proxyStatus(rw, r, db, outbound)
 	}
+}
 
-	if resp.StatusCode != 200 {
-		c.err = fmt.Errorf("Error in HTTP request: %d", resp.StatusCode)
-		c.job.EventErr("proxy.request_url", c.err)
+// proxyStatus gets a status from ob-relay
+func (c *Context) proxyStatus(rw web.ResponseWriter, r *web.Request, db *sql.DB, outbound *outboundLimiter) {
+	ip := r.PathParams["ip"]
+	s := currentSettings()
+	if !s.allowTarget(ip) {
+		c.job.EventErr("proxy.target_not_allowed", errTargetNotAllowed)
+		writeJSONStatus(c, rw, http.StatusForbidden, map[string]string{"error": errTargetNotAllowed.Error()})
 		return
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		c.err = err
-		c.job.EventErr("proxy.read_body", c.err)
+	// Check the target was provisioned for the client before spending the
+	// outbound budget or serving the last known state
+	if s.targetTokens.enabled() {
+		token := r.Header.Get(targetTokenHeader)
+		if token == "" {
+			token = r.URL.Query().Get(targetTokenParam)
+		}
+		err := s.targetTokens.verify(token, ip, time.Now())
+		if err != nil && s.targetTokens.enforced() {
+			c.job.EventErr("target_token.rejected", err)
+			writeJSONStatus(c, rw, http.StatusForbidden, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.job.EventErr("target_token.would_reject", err)
+		}
+	}
+
+	allowed, limit, retryAfter := outbound.allow(ip, s, time.Now())
+	if !allowed {
+		c.job.Event("outbound.throttled." + limit)
+		serveLastKnownState(c, rw, db, ip, retryAfter)
 		return
 	}
 
-	status := &StatusResponse{}
-	err = json.Unmarshal(body, status)
+	c.probed = true
+	body, status, timing, err := fetchNodeStatus(r.Context(), c.job, ip)
+	if ServerTimingEnabled && timing != nil {
+		rw.Header().Set("Server-Timing", timing.serverTiming())
+		rw.Header().Set("Timing-Allow-Origin", accessControlAllowOriginHeader)
+	}
 	if err != nil {
 		c.err = err
-		c.job.EventErr("proxy.parse_body", c.err)
+		c.probeErr = err
 		return
 	}
 
@@ -111,33 +239,83 @@ func (c *Context) StatusRequestProxyHandler(rw web.ResponseWriter, r *web.Reques
 	}
 }
 
-func newUpdateNodeStateMiddleware(db *sql.DB) (middlewareFunc, error) {
+// fetchNodeStatus requests the status endpoint of the ob-relay at the given ip
+// and returns the raw body along with the parsed response and a breakdown of
+// the time spent on the request. The request ID carried by ctx is forwarded
+// to the relay. Errors are emitted on the given job before being returned.
+func fetchNodeStatus(ctx context.Context, job *health.Job, ip string) ([]byte, *StatusResponse, *upstreamTiming, error) {
+	url := "https://" + net.JoinHostPort(ip, relayPort) + "/status"
+
+	ctx, cancel := context.WithTimeout(ctx, currentSettings().upstreamTimeout)
+	defer cancel()
+
+	ctx, span := tracer.StartSpan(ctx, "GET /status", spanKindClient)
+	span.SetAttribute("http.method", "GET")
+	span.SetAttribute("http.url", url)
+	span.SetAttribute("net.peer.name", ip)
+	defer span.Finish()
+
+	timing := &upstreamTiming{}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		span.SetError(err)
+		return nil, nil, nil, job.EventErr("proxy.new_request", err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, timing.clientTrace()))
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	injectTraceparent(ctx, req.Header)
+
+	// Perform the request
+	defer upstreamPoolStats.begin()()
+	start := time.Now()
+	resp, err := HTTPClient.Do(req)
+	timing.Total = time.Since(start)
+	timing.emit(job)
+	if err != nil {
+		span.SetError(err)
+		return nil, nil, timing, job.EventErr("proxy.request_url", err)
+	}
+	defer resp.Body.Close()
+	job.Timing("proxy.upstream", timing.Total.Nanoseconds())
+	span.SetAttribute("http.status_code", resp.StatusCode)
+
+	if resp.StatusCode != 200 {
+		err = &upstreamStatusError{StatusCode: resp.StatusCode}
+		span.SetError(err)
+		return nil, nil, timing, job.EventErr("proxy.request_url", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		span.SetError(err)
+		return nil, nil, timing, job.EventErr("proxy.read_body", err)
+	}
+
+	status := &StatusResponse{}
+	err = json.Unmarshal(body, status)
+	if err != nil {
+		span.SetError(err)
+		return nil, nil, timing, job.EventErr("proxy.parse_body", err)
+	}
+
+	return body, status, timing, nil
+}
+
+func newUpdateNodeStateMiddleware(db *sql.DB, webhooks *webhookDispatcher) (middlewareFunc, error) {
 	return func(c *Context, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
-		c.nodeStatus = "INSTALLING_OPENBAZAAR_RELAY"
+		c.nodeStatus = defaultNodeState
 
 		// Execute handler
 		next(rw, req)
 
-		// Update state
-		updateStmt, err := db.Prepare(`
-      WITH new (ip, state) AS ( VALUES(?, ?) )
-      INSERT OR REPLACE INTO nodes (ip, state, updated_at, created_at)
-      SELECT new.ip, new.state, CURRENT_TIMESTAMP, COALESCE(old.created_at, CURRENT_TIMESTAMP)
-      FROM new
-        LEFT JOIN nodes AS old
-        ON new.ip = old.ip AND new.state = old.state
-      LIMIT 1;
-    `)
-		defer updateStmt.Close()
-		if err != nil {
-			c.job.EventErr("update_node_state.prepare", err)
+		// Only requests that probed a node report on it
+		if !c.probed {
 			return
 		}
 
-		_, err = updateStmt.Exec(req.PathParams["ip"], c.nodeStatus)
-		if err != nil {
-			c.job.EventErr("update_node_state.execute", err)
-			return
-		}
+		// Update state
+		persistProbeResult(req.Context(), c.job, db, webhooks, req.PathParams["ip"], c.nodeStatus, c.probeErr)
 	}, nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// gracefulShutdown stops the server in order: readiness fails, listeners stop
+// accepting connections and drain in-flight requests, background workers
+// finish their current cycle and the database is closed once nothing writes
+// to it anymore
+type gracefulShutdown struct {
+	servers   []*http.Server
+	readiness *readinessChecker
+	workers   []worker
+	db        *sql.DB
+
+	// drainDelay is how long readiness fails before listeners close, giving
+	// load balancers time to stop sending traffic
+	drainDelay time.Duration
+
+	// timeout bounds the whole shutdown after drainDelay
+	timeout time.Duration
+}
+
+// Run shuts the server down after receiving sig and reports whether every
+// step finished cleanly before the deadline
+func (s *gracefulShutdown) Run(sig os.Signal) bool {
+	job := stream.NewJob("shutdown")
+	job.KeyValue("signal", sig.String())
+	start := time.Now()
+	clean := true
+
+	notify("STOPPING=1")
+	s.readiness.Shutdown()
+	if s.drainDelay > 0 {
+		job.EventKv("shutdown.drain_delay", health.Kvs{"delay": s.drainDelay.String()})
+		time.Sleep(s.drainDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	// Stop accepting connections and wait for in-flight requests, along with
+	// the node state writes they make
+	for _, server := range s.servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			clean = false
+			job.EventErrKv("shutdown.drain", err, health.Kvs{"addr": server.Addr})
+			server.Close()
+		}
+	}
+
+	// Let workers finish writing their current cycle
+	stopped := make(chan struct{})
+	go func() {
+		for _, w := range s.workers {
+			w.Stop()
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		clean = false
+		job.EventErr("shutdown.stop_workers", ctx.Err())
+	}
+
+	// Writes are synchronous, so once requests and workers are done the
+	// database only needs closing
+	err := s.db.Close()
+	if err != nil {
+		clean = false
+		job.EventErr("shutdown.close_db", err)
+	}
+
+	job.KeyValue("clean", strconv.FormatBool(clean))
+	job.Timing("shutdown.duration", time.Since(start).Nanoseconds())
+	if clean {
+		job.Complete(health.Success)
+	} else {
+		job.Complete(health.Error)
+	}
+	return clean
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// Names of the configurable health sinks
+const (
+	sinkWriter      = "writer"
+	sinkJSONWriter  = "json_writer"
+	sinkStatsD      = "statsd"
+	sinkJSONPolling = "json_polling"
+)
+
+// sinkCmdKind is the kind of emission queued on an asyncSink
+type sinkCmdKind int
+
+const (
+	sinkCmdEvent sinkCmdKind = iota
+	sinkCmdEventErr
+	sinkCmdTiming
+	sinkCmdGauge
+	sinkCmdComplete
+)
+
+// sinkCmd is an emission queued on an asyncSink
+type sinkCmd struct {
+	kind   sinkCmdKind
+	job    string
+	event  string
+	err    error
+	nanos  int64
+	value  float64
+	status health.CompletionStatus
+	kvs    map[string]string
+}
+
+// asyncSink wraps a health.Sink so emitting never blocks the caller. Emissions
+// are queued on a bounded buffer and dropped when the wrapped sink can't keep
+// up.
+type asyncSink struct {
+	name    string
+	sink    health.Sink
+	dropped uint64
+
+	mu     sync.RWMutex
+	closed bool
+	cmds   chan sinkCmd
+	done   chan struct{}
+}
+
+// newAsyncSink wraps sink with a buffer of the given size
+func newAsyncSink(name string, sink health.Sink, bufferSize int) *asyncSink {
+	s := &asyncSink{
+		name: name,
+		sink: sink,
+		cmds: make(chan sinkCmd, bufferSize),
+		done: make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *asyncSink) loop() {
+	defer close(s.done)
+	for cmd := range s.cmds {
+		switch cmd.kind {
+		case sinkCmdEvent:
+			s.sink.EmitEvent(cmd.job, cmd.event, cmd.kvs)
+		case sinkCmdEventErr:
+			s.sink.EmitEventErr(cmd.job, cmd.event, cmd.err, cmd.kvs)
+		case sinkCmdTiming:
+			s.sink.EmitTiming(cmd.job, cmd.event, cmd.nanos, cmd.kvs)
+		case sinkCmdGauge:
+			s.sink.EmitGauge(cmd.job, cmd.event, cmd.value, cmd.kvs)
+		case sinkCmdComplete:
+			s.sink.EmitComplete(cmd.job, cmd.status, cmd.nanos, cmd.kvs)
+		}
+	}
+}
+
+// enqueue queues the command or drops it if the buffer is full
+func (s *asyncSink) enqueue(cmd sinkCmd) {
+	// Jobs may keep changing their key values after emitting
+	if len(cmd.kvs) > 0 {
+		kvs := make(map[string]string, len(cmd.kvs))
+		for k, v := range cmd.kvs {
+			kvs[k] = v
+		}
+		cmd.kvs = kvs
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+
+	select {
+	case s.cmds <- cmd:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns the number of emissions dropped so far
+func (s *asyncSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Backlog returns the number of queued emissions and the buffer size
+func (s *asyncSink) Backlog() (int, int) {
+	return len(s.cmds), cap(s.cmds)
+}
+
+// Close stops accepting emissions and waits for the queued ones to be
+// written, up to timeout
+func (s *asyncSink) Close(timeout time.Duration) {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.cmds)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		return
+	}
+
+	// Flush sinks that buffer on their own, such as statsd
+	if d, ok := s.sink.(interface {
+		Drain()
+	}); ok {
+		d.Drain()
+	}
+}
+
+// EmitEvent queues the event
+func (s *asyncSink) EmitEvent(job string, event string, kvs map[string]string) {
+	s.enqueue(sinkCmd{kind: sinkCmdEvent, job: job, event: event, kvs: kvs})
+}
+
+// EmitEventErr queues the error
+func (s *asyncSink) EmitEventErr(job string, event string, inputErr error, kvs map[string]string) {
+	s.enqueue(sinkCmd{kind: sinkCmdEventErr, job: job, event: event, err: inputErr, kvs: kvs})
+}
+
+// EmitTiming queues the timing
+func (s *asyncSink) EmitTiming(job string, event string, nanoseconds int64, kvs map[string]string) {
+	s.enqueue(sinkCmd{kind: sinkCmdTiming, job: job, event: event, nanos: nanoseconds, kvs: kvs})
+}
+
+// EmitGauge queues the gauge
+func (s *asyncSink) EmitGauge(job string, event string, value float64, kvs map[string]string) {
+	s.enqueue(sinkCmd{kind: sinkCmdGauge, job: job, event: event, value: value, kvs: kvs})
+}
+
+// EmitComplete queues the job completion
+func (s *asyncSink) EmitComplete(job string, status health.CompletionStatus, nanoseconds int64, kvs map[string]string) {
+	s.enqueue(sinkCmd{kind: sinkCmdComplete, job: job, status: status, nanos: nanoseconds, kvs: kvs})
+}
+
+// sinkSet is the set of configured health sinks
+type sinkSet struct {
+	sinks   []*asyncSink
+	polling *health.JsonPollingSink
+	files   []io.Closer
+}
+
+// configureSinks creates the configured health sinks and adds them to the
+// stream
+func configureSinks(stream *health.Stream, cfg SinksConfig) (*sinkSet, error) {
+	set := &sinkSet{}
+
+	for _, name := range cfg.Names {
+		var sink health.Sink
+		switch name {
+		case sinkWriter:
+			w, err := set.openWriter(cfg.WriterFile)
+			if err != nil {
+				return nil, err
+			}
+			sink = &health.WriterSink{Writer: w}
+
+		case sinkJSONWriter:
+			w, err := set.openWriter(cfg.JSONWriterFile)
+			if err != nil {
+				return nil, err
+			}
+			sink = &health.JsonWriterSink{Writer: &lineWriter{w}}
+
+		case sinkStatsD:
+			if cfg.StatsD.Addr == "" {
+				return nil, fmt.Errorf("A statsd address is required for the %s sink", sinkStatsD)
+			}
+			statsd, err := health.NewStatsDSink(cfg.StatsD.Addr, &health.StatsDSinkOptions{
+				Prefix:             cfg.StatsD.Prefix,
+				SkipNestedEvents:   cfg.StatsD.SkipNestedEvents,
+				SkipTopLevelEvents: cfg.StatsD.SkipTopLevelEvents,
+			})
+			if err != nil {
+				return nil, err
+			}
+			sink = statsd
+
+		case sinkJSONPolling:
+			set.polling = health.NewJsonPollingSink(
+				time.Duration(cfg.JSONPolling.Interval),
+				time.Duration(cfg.JSONPolling.Retain),
+			)
+			sink = set.polling
+
+		default:
+			return nil, fmt.Errorf("Unknown health sink: %q", name)
+		}
+
+		async := newAsyncSink(name, sink, cfg.BufferSize)
+		set.sinks = append(set.sinks, async)
+		stream.AddSink(async)
+	}
+
+	// The admin listener always serves the health aggregations, so aggregate
+	// even if the JSON polling sink isn't configured
+	if set.polling == nil {
+		set.polling = health.NewJsonPollingSink(
+			time.Duration(cfg.JSONPolling.Interval),
+			time.Duration(cfg.JSONPolling.Retain),
+		)
+		async := newAsyncSink(sinkJSONPolling, set.polling, cfg.BufferSize)
+		set.sinks = append(set.sinks, async)
+		stream.AddSink(async)
+	}
+
+	return set, nil
+}
+
+// openWriter opens the file at path for appending, or returns stdout if path
+// is empty
+func (set *sinkSet) openWriter(path string) (io.Writer, error) {
+	if path == "" {
+		return os.Stdout, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	set.files = append(set.files, f)
+	return f, nil
+}
+
+// lineWriter terminates every write with a newline. JsonWriterSink writes one
+// JSON object per write without a separator.
+type lineWriter struct {
+	io.Writer
+}
+
+// Write writes p followed by a newline
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(append(p, '\n'))
+	if n > len(p) {
+		n = len(p)
+	}
+	return n, err
+}
+
+// Close flushes the sinks, waiting up to timeout for each, and closes any
+// files they write to
+func (set *sinkSet) Close(timeout time.Duration) {
+	for _, s := range set.sinks {
+		s.Close(timeout)
+	}
+	for _, f := range set.files {
+		f.Close()
+	}
+}
+
+// healthError is an error emitted on the health stream
+type healthError struct {
+	At    time.Time
+	Job   string
+	Event string
+	Error string
+	Kvs   map[string]string
+}
+
+// errorLogSink is a health.Sink that keeps the most recent errors in memory
+// for the dashboard
+type errorLogSink struct {
+	mu     sync.Mutex
+	errors []healthError
+	next   int
+	full   bool
+}
+
+// newErrorLogSink creates an errorLogSink that keeps up to size errors
+func newErrorLogSink(size int) *errorLogSink {
+	return &errorLogSink{errors: make([]healthError, size)}
+}
+
+// Recent returns the kept errors, most recent first
+func (s *errorLogSink) Recent() []healthError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.next
+	if s.full {
+		n = len(s.errors)
+	}
+	recent := make([]healthError, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, s.errors[(s.next-i+len(s.errors))%len(s.errors)])
+	}
+	return recent
+}
+
+// EmitEvent ignores the event
+func (s *errorLogSink) EmitEvent(job string, event string, kvs map[string]string) {
+}
+
+// EmitEventErr keeps the error, replacing the oldest one if full
+func (s *errorLogSink) EmitEventErr(job string, event string, inputErr error, kvs map[string]string) {
+	if len(s.errors) == 0 {
+		return
+	}
+
+	e := healthError{At: time.Now().UTC(), Job: job, Event: event, Error: inputErr.Error(), Kvs: map[string]string{}}
+	for k, v := range kvs {
+		e.Kvs[k] = v
+	}
+
+	s.mu.Lock()
+	s.errors[s.next] = e
+	s.next = (s.next + 1) % len(s.errors)
+	if s.next == 0 {
+		s.full = true
+	}
+	s.mu.Unlock()
+}
+
+// EmitTiming ignores the timing
+func (s *errorLogSink) EmitTiming(job string, event string, nanoseconds int64, kvs map[string]string) {
+}
+
+// EmitGauge ignores the gauge
+func (s *errorLogSink) EmitGauge(job string, event string, value float64, kvs map[string]string) {
+}
+
+// EmitComplete ignores the job completion
+func (s *errorLogSink) EmitComplete(job string, status health.CompletionStatus, nanoseconds int64, kvs map[string]string) {
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// incidentKindStuck is the kind of incident raised when a node dwells in a
+// state for longer than its threshold
+const incidentKindStuck = "stuck"
+
+// incident is a problem detected with a node
+type incident struct {
+	ID               int64      `json:"id"`
+	Kind             string     `json:"kind"`
+	IP               string     `json:"ip"`
+	State            string     `json:"state"`
+	ThresholdSeconds int64      `json:"threshold_seconds"`
+	OpenedAt         time.Time  `json:"opened_at"`
+	ResolvedAt       *time.Time `json:"resolved_at"`
+}
+
+// stuckDetector periodically compares the time each node has spent in its
+// current state against per-state thresholds, and opens or resolves stuck
+// incidents accordingly
+type stuckDetector struct {
+	db         *sql.DB
+	interval   time.Duration
+	thresholds map[string]time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newStuckDetector creates a stuckDetector that runs every interval
+func newStuckDetector(db *sql.DB, interval time.Duration, thresholds map[string]time.Duration) *stuckDetector {
+	return &stuckDetector{
+		db:         db,
+		interval:   interval,
+		thresholds: thresholds,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start begins checking in the background
+func (d *stuckDetector) Start() {
+	go d.loop()
+}
+
+// Stop signals the detector to stop and waits for the current check to finish
+func (d *stuckDetector) Stop() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *stuckDetector) loop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			job := stream.NewJob("stuck_detector.check")
+			err := d.check(job)
+			if err != nil {
+				job.Complete(health.Error)
+				continue
+			}
+			job.Complete(health.Success)
+		}
+	}
+}
+
+// check opens an incident for every node past its state's threshold and
+// resolves open incidents for nodes that have left the incident's state
+func (d *stuckDetector) check(job *health.Job) error {
+	states, err := listCurrentNodeStates(d.db)
+	if err != nil {
+		return job.EventErr("stuck_detector.list_nodes", err)
+	}
+
+	open, err := listIncidents(d.db, incidentKindStuck, true)
+	if err != nil {
+		return job.EventErr("stuck_detector.list_incidents", err)
+	}
+
+	// Index open incidents by node
+	openByIP := map[string]incident{}
+	for _, inc := range open {
+		openByIP[inc.IP] = inc
+	}
+
+	current := map[string]bool{}
+	for _, s := range states {
+		current[s.IP] = true
+
+		// Resolve an open incident if the node left its state
+		inc, hasOpen := openByIP[s.IP]
+		if hasOpen && inc.State != s.State {
+			err = d.resolve(job, inc)
+			if err != nil {
+				return err
+			}
+			hasOpen = false
+		}
+
+		threshold, ok := d.thresholds[s.State]
+		if !ok || hasOpen || time.Duration(s.DwellSeconds)*time.Second < threshold {
+			continue
+		}
+
+		_, err = d.db.Exec(`INSERT INTO incidents (kind, ip, state, threshold_seconds) VALUES (?, ?, ?, ?);`,
+			incidentKindStuck, s.IP, s.State, int64(threshold/time.Second))
+		if err != nil {
+			return job.EventErr("stuck_detector.open_incident", err)
+		}
+		job.EventKv("stuck_detector.incident_opened", health.Kvs{
+			"ip":        s.IP,
+			"state":     s.State,
+			"dwell":     (time.Duration(s.DwellSeconds) * time.Second).String(),
+			"threshold": threshold.String(),
+		})
+	}
+
+	// Resolve incidents for nodes that no longer exist
+	for ip, inc := range openByIP {
+		if current[ip] {
+			continue
+		}
+		err = d.resolve(job, inc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolve marks the incident as resolved
+func (d *stuckDetector) resolve(job *health.Job, inc incident) error {
+	_, err := d.db.Exec(`UPDATE incidents SET resolved_at = CURRENT_TIMESTAMP WHERE id = ?;`, inc.ID)
+	if err != nil {
+		return job.EventErr("stuck_detector.resolve_incident", err)
+	}
+	job.EventKv("stuck_detector.incident_resolved", health.Kvs{
+		"ip":    inc.IP,
+		"state": inc.State,
+		"id":    strconv.FormatInt(inc.ID, 10),
+	})
+	return nil
+}
+
+// listIncidents returns incidents of the given kind, or of every kind if kind
+// is empty, optionally limited to those that are still open
+func listIncidents(db *sql.DB, kind string, openOnly bool) ([]incident, error) {
+	query := `SELECT id, kind, ip, state, threshold_seconds, opened_at, resolved_at
+    FROM incidents
+    WHERE (? = '' OR kind = ?) AND (? = 0 OR resolved_at IS NULL)
+    ORDER BY id DESC;`
+
+	open := 0
+	if openOnly {
+		open = 1
+	}
+
+	rows, err := db.Query(query, kind, kind, open)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	incidents := []incident{}
+	for rows.Next() {
+		var inc incident
+		err = rows.Scan(&inc.ID, &inc.Kind, &inc.IP, &inc.State, &inc.ThresholdSeconds, &inc.OpenedAt, &inc.ResolvedAt)
+		if err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, inc)
+	}
+
+	return incidents, rows.Err()
+}
+
+// parseStateThresholds parses a comma separated list of STATE=duration pairs
+func parseStateThresholds(s string) (map[string]time.Duration, error) {
+	thresholds := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid state threshold: %q", pair)
+		}
+
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid state threshold for %s: %s", parts[0], err)
+		}
+		thresholds[parts[0]] = d
+	}
+	return thresholds, nil
+}
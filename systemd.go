@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// Names of activated sockets, set with FileDescriptorName= in the socket
+// unit. Sockets with any other name are used for the public listener.
+const (
+	activatedAdmin    = "admin"
+	activatedRedirect = "redirect"
+	activatedPublic   = "public"
+)
+
+// activatedListeners returns the listeners passed by systemd socket
+// activation by name, or an empty map if the process wasn't socket activated.
+// The activation environment is unset so it isn't inherited.
+func activatedListeners() (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return listeners, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := activatedPublic
+		if i < len(names) && (names[i] == activatedAdmin || names[i] == activatedRedirect) {
+			name = names[i]
+		}
+		if _, ok := listeners[name]; ok {
+			return nil, fmt.Errorf("More than one activated socket for the %s listener", name)
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid activated socket %d: %s", fd, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// listen returns the activated listener called name if there is one, and
+// otherwise listens on the TCP address addr
+func listen(activated map[string]net.Listener, name string, addr string) (net.Listener, error) {
+	if l, ok := activated[name]; ok {
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on a Unix domain socket at path with the given
+// permissions, replacing a socket left behind by a previous run
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseSocketMode parses octal file permissions such as 0660
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid socket mode: %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// sdNotify sends a state such as READY=1 to the service manager. It does
+// nothing unless the service manager set NOTIFY_SOCKET.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify sends state to the service manager, emitting any error
+func notify(state string) {
+	err := sdNotify(state)
+	if err != nil {
+		stream.EventErr("systemd.notify", err)
+	}
+}
+
+// watchdogInterval returns the interval the service manager expects watchdog
+// notifications at, or 0 if the watchdog isn't enabled for this process
+func watchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("Invalid WATCHDOG_USEC: " + usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// watchdogNotifier keeps the service manager's watchdog from firing by
+// sending WATCHDOG=1 at half the watchdog interval
+type watchdogNotifier struct {
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newWatchdogNotifier creates a watchdogNotifier for a watchdog that fires
+// after interval
+func newWatchdogNotifier(interval time.Duration) *watchdogNotifier {
+	return &watchdogNotifier{
+		interval: interval / 2,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins notifying in the background
+func (w *watchdogNotifier) Start() {
+	go w.loop()
+}
+
+// Stop stops notifying and waits for the notifier to finish
+func (w *watchdogNotifier) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *watchdogNotifier) loop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			notify("WATCHDOG=1")
+		}
+	}
+}
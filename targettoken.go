@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Target token modes. In log-only mode invalid tokens are reported but the
+// request is proxied anyway.
+const (
+	targetTokenOff     = "off"
+	targetTokenLogOnly = "log-only"
+	targetTokenEnforce = "enforce"
+)
+
+// targetTokenHeader and targetTokenParam carry the target token of a status
+// request. The query parameter spares browsers a CORS preflight.
+const (
+	targetTokenHeader = "X-Target-Token"
+	targetTokenParam  = "token"
+)
+
+// minTargetTokenHMACKeyLen is the shortest HMAC key accepted, in bytes
+const minTargetTokenHMACKeyLen = 32
+
+// Target token errors
+var (
+	errTargetTokenMissing  = errors.New("A target token is required")
+	errTargetTokenInvalid  = errors.New("Invalid target token")
+	errTargetTokenExpired  = errors.New("Target token has expired")
+	errTargetTokenMismatch = errors.New("Target token is for another target")
+)
+
+// targetTokenVerifier verifies target tokens: JWTs issued by the backend,
+// signed with HS256 or EdDSA, whose target claim names the ip a browser may
+// query until the exp claim
+type targetTokenVerifier struct {
+	mode    string
+	hmacKey []byte
+	edKey   ed25519.PublicKey
+
+	// leeway is the clock skew tolerated when checking exp and nbf
+	leeway time.Duration
+}
+
+// targetTokenHeaderFields are the fields of the header of a target token
+type targetTokenHeaderFields struct {
+	Alg string `json:"alg"`
+}
+
+// targetTokenClaims are the claims of a target token, with times in seconds
+// since the epoch
+type targetTokenClaims struct {
+	Target    string `json:"target"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// newTargetTokenVerifier creates a targetTokenVerifier from the config
+func newTargetTokenVerifier(cfg TargetTokenConfig) (*targetTokenVerifier, error) {
+	v := &targetTokenVerifier{mode: cfg.Mode, leeway: time.Duration(cfg.Leeway)}
+	switch cfg.Mode {
+	case targetTokenOff, targetTokenLogOnly, targetTokenEnforce:
+	default:
+		return nil, fmt.Errorf("Invalid mode %q, expected %s, %s or %s", cfg.Mode, targetTokenOff, targetTokenLogOnly, targetTokenEnforce)
+	}
+
+	if cfg.HMACKey != "" {
+		if len(cfg.HMACKey) < minTargetTokenHMACKeyLen {
+			return nil, fmt.Errorf("The HMAC key must be at least %d bytes", minTargetTokenHMACKeyLen)
+		}
+		v.hmacKey = []byte(cfg.HMACKey)
+	}
+	if cfg.Ed25519PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cfg.Ed25519PublicKey))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("The Ed25519 public key must be %d base64 encoded bytes", ed25519.PublicKeySize)
+		}
+		v.edKey = ed25519.PublicKey(key)
+	}
+
+	if v.enabled() && v.hmacKey == nil && v.edKey == nil {
+		return nil, errors.New("An HMAC key or an Ed25519 public key is required unless the mode is off")
+	}
+	return v, nil
+}
+
+// enabled reports whether tokens are checked at all
+func (v *targetTokenVerifier) enabled() bool {
+	return v != nil && v.mode != targetTokenOff
+}
+
+// enforced reports whether requests with an invalid token are rejected
+func (v *targetTokenVerifier) enforced() bool {
+	return v != nil && v.mode == targetTokenEnforce
+}
+
+// verify checks that token is validly signed, current and permits ip
+func (v *targetTokenVerifier) verify(token string, ip string, now time.Time) error {
+	if token == "" {
+		return errTargetTokenMissing
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errTargetTokenInvalid
+	}
+
+	var header targetTokenHeaderFields
+	err := decodeTokenSegment(parts[0], &header)
+	if err != nil {
+		return errTargetTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errTargetTokenInvalid
+	}
+
+	// Only accept the algorithms of the configured keys
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && v.hmacKey != nil:
+		mac := hmac.New(sha256.New, v.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errTargetTokenInvalid
+		}
+	case header.Alg == "EdDSA" && v.edKey != nil:
+		if !ed25519.Verify(v.edKey, signed, sig) {
+			return errTargetTokenInvalid
+		}
+	default:
+		return errTargetTokenInvalid
+	}
+
+	var claims targetTokenClaims
+	err = decodeTokenSegment(parts[1], &claims)
+	if err != nil || claims.ExpiresAt == 0 {
+		return errTargetTokenInvalid
+	}
+	if now.Add(-v.leeway).After(time.Unix(claims.ExpiresAt, 0)) {
+		return errTargetTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(v.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return errTargetTokenInvalid
+	}
+
+	target := net.ParseIP(claims.Target)
+	if target == nil || !target.Equal(net.ParseIP(ip)) {
+		return errTargetTokenMismatch
+	}
+	return nil
+}
+
+// decodeTokenSegment decodes a base64url encoded JSON segment of a token
+func decodeTokenSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
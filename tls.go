@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// tlsVersions are the configurable minimum TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a TLS version such as 1.2
+func parseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimSpace(s)]
+	if !ok {
+		return 0, fmt.Errorf("Invalid TLS version: %q", s)
+	}
+	return v, nil
+}
+
+// parseCipherSuites parses a comma separated list of cipher suite names as
+// listed by tls.CipherSuites. Suites known to be insecure are rejected.
+// Suites only apply up to TLS 1.2 as TLS 1.3 suites aren't configurable.
+func parseCipherSuites(s string) ([]uint16, error) {
+	secure := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite: %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// newServerTLSConfig creates the TLS config of the server with the certificate
+// from the given files and the reloader that keeps it up to date
+func newServerTLSConfig(certFile string, keyFile string, minVersion string, cipherSuites string, reloadInterval time.Duration) (*tls.Config, *certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("Both a TLS certificate and key file are required")
+	}
+
+	version, err := parseTLSVersion(minVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	suites, err := parseCipherSuites(cipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+	reloader, err := newCertReloader(certFile, keyFile, reloadInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     version,
+		CipherSuites:   suites,
+		GetCertificate: reloader.GetCertificate,
+	}
+	return config, reloader, nil
+}
+
+// certReloader serves a certificate loaded from files and reloads it when the
+// files change or the process receives SIGHUP. A failed reload keeps serving
+// the previous certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newCertReloader loads the certificate and creates a certReloader that checks
+// the files for changes every interval
+func newCertReloader(certFile string, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for use as
+// tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Start begins watching for changes in the background
+func (r *certReloader) Start() {
+	go r.loop()
+}
+
+// Stop signals the reloader to stop and waits for it to finish
+func (r *certReloader) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *certReloader) loop() {
+	defer close(r.done)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-hup:
+			r.reloadWithJob("sighup")
+		case <-ticker.C:
+			modTime, err := r.latestModTime()
+			if err != nil {
+				stream.EventErrKv("tls.stat_cert", err, health.Kvs{"cert_file": r.certFile})
+				continue
+			}
+			r.mu.RLock()
+			changed := modTime.After(r.modTime)
+			r.mu.RUnlock()
+			if changed {
+				r.reloadWithJob("file_changed")
+			}
+		}
+	}
+}
+
+// reloadWithJob reloads the certificate, instrumented with a job
+func (r *certReloader) reloadWithJob(trigger string) {
+	job := stream.NewJob("tls.reload")
+	job.KeyValue("trigger", trigger)
+	job.KeyValue("cert_file", r.certFile)
+
+	err := r.reload()
+	if err != nil {
+		job.EventErr("tls.reload", err)
+		job.Complete(health.Error)
+		return
+	}
+	job.Complete(health.Success)
+}
+
+// reload loads the certificate from its files and starts serving it
+func (r *certReloader) reload() error {
+	// Stat before loading so a change made while loading is picked up by the
+	// next check
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// latestModTime returns the most recent modification time of the files
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// newHTTPSRedirectHandler returns a handler that redirects every request to
+// the same URL over HTTPS on httpsPort
+func newHTTPSRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// traceparentHeader is the W3C trace context header
+const traceparentHeader = "traceparent"
+
+// traceServiceName is the service.name resource attribute of exported spans
+const traceServiceName = "corsproxy"
+
+// Span kinds as defined by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanStatusError is the OTLP status code of failed spans
+const spanStatusError = 2
+
+// tracer is the tracer used for instrumentation. It propagates trace context
+// but exports nothing until configured.
+var tracer = newTracer(nil, 0)
+
+// spanContext identifies a span within a trace
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// traceparent formats the span context as a traceparent header value
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a traceparent header value
+func parseTraceparent(s string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	// Version ff is invalid and version 00 has exactly four fields
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+
+	_, err := hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	if err != nil || sc.TraceID == [16]byte{} {
+		return sc, false
+	}
+	_, err = hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	if err != nil || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&1 == 1
+
+	return sc, true
+}
+
+// span is a timed operation within a trace
+type span struct {
+	tracer *Tracer
+
+	spanContext
+	ParentSpanID [8]byte
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+
+	mu            sync.Mutex
+	attributes    map[string]interface{}
+	statusCode    int
+	statusMessage string
+	ended         bool
+}
+
+// SetName renames the span
+func (s *span) SetName(name string) {
+	s.mu.Lock()
+	s.Name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute sets an attribute on the span. Values are strings, bools,
+// ints or float64s.
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *span) SetError(err error) {
+	s.mu.Lock()
+	s.statusCode = spanStatusError
+	s.statusMessage = err.Error()
+	s.mu.Unlock()
+}
+
+// Finish ends the span and queues it for export if it's sampled
+func (s *span) Finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.export(s)
+	}
+}
+
+// spanKey is the context key of the current span
+type spanKey struct{}
+
+// spanFromContext returns the current span of ctx or nil
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// Tracer creates spans and hands sampled ones to an exporter
+type Tracer struct {
+	exporter    *spanExporter
+	sampleRatio float64
+}
+
+// newTracer creates a Tracer that samples new traces with the given ratio and
+// exports sampled spans to exporter, if not nil. Traces continued from a
+// traceparent keep the caller's sampling decision.
+func newTracer(exporter *spanExporter, sampleRatio float64) *Tracer {
+	return &Tracer{exporter: exporter, sampleRatio: sampleRatio}
+}
+
+// StartSpan starts a span that is a child of the current span of ctx, or the
+// root of a new trace if there is none
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	var parent *spanContext
+	if p := spanFromContext(ctx); p != nil {
+		parent = &p.spanContext
+	}
+	return t.startSpan(ctx, name, kind, parent)
+}
+
+// StartServerSpan starts a server span continuing the trace of the incoming
+// request's traceparent header, if valid
+func (t *Tracer) StartServerSpan(ctx context.Context, name string, header http.Header) (context.Context, *span) {
+	var parent *spanContext
+	if sc, ok := parseTraceparent(header.Get(traceparentHeader)); ok {
+		parent = &sc
+	}
+	return t.startSpan(ctx, name, spanKindServer, parent)
+}
+
+func (t *Tracer) startSpan(ctx context.Context, name string, kind int, parent *spanContext) (context.Context, *span) {
+	s := &span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	randomBytes(s.SpanID[:])
+
+	if parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentSpanID = parent.SpanID
+		s.Sampled = parent.Sampled
+	} else {
+		randomBytes(s.TraceID[:])
+		s.Sampled = t.sample(s.TraceID)
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample decides whether a new trace is sampled from its ID, so the decision
+// is consistent for a trace
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	if t.sampleRatio <= 0 {
+		return false
+	}
+	bound := uint64(t.sampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+// injectTraceparent sets the traceparent header of an outgoing request to the
+// current span of ctx
+func injectTraceparent(ctx context.Context, header http.Header) {
+	if s := spanFromContext(ctx); s != nil {
+		header.Set(traceparentHeader, s.traceparent())
+	}
+}
+
+// randomBytes fills b with random bytes
+func randomBytes(b []byte) {
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// spanExporter batches sampled spans and writes them as OTLP/JSON export
+// requests to a file or posts them to an OTLP/HTTP collector
+type spanExporter struct {
+	writer   io.Writer
+	url      string
+	client   *http.Client
+	interval time.Duration
+
+	spans chan *span
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// spanExporterBatchSize is the maximum number of spans per export request
+const spanExporterBatchSize = 512
+
+// newSpanExporter creates a spanExporter for the target, which is either a
+// file:// URL or the http(s):// URL of an OTLP/HTTP traces endpoint
+func newSpanExporter(target string, interval time.Duration) (*spanExporter, error) {
+	e := &spanExporter{
+		interval: interval,
+		spans:    make(chan *span, 4*spanExporterBatchSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	switch {
+	case strings.HasPrefix(target, "file://"):
+		f, err := os.OpenFile(strings.TrimPrefix(target, "file://"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		e.writer = f
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		e.url = target
+		e.client = &http.Client{Timeout: HTTPTimeout}
+	default:
+		return nil, fmt.Errorf("Invalid trace export target: %q", target)
+	}
+
+	return e, nil
+}
+
+// export queues a span, dropping it if the exporter can't keep up
+func (e *spanExporter) export(s *span) {
+	select {
+	case e.spans <- s:
+	default:
+		stream.Event("tracing.span_dropped")
+	}
+}
+
+// Start begins exporting in the background
+func (e *spanExporter) Start() {
+	go e.loop()
+}
+
+// Stop flushes queued spans and stops exporting
+func (e *spanExporter) Stop() {
+	close(e.stop)
+	<-e.done
+	if c, ok := e.writer.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (e *spanExporter) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	batch := []*span{}
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= spanExporterBatchSize {
+				e.flush(batch)
+				batch = []*span{}
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = []*span{}
+		case <-e.stop:
+			// Drain whatever was queued before stopping
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					e.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush exports a batch of spans
+func (e *spanExporter) flush(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(otlpExportRequest(batch))
+	if err != nil {
+		stream.EventErr("tracing.marshal", err)
+		return
+	}
+
+	if e.writer != nil {
+		_, err = e.writer.Write(append(body, '\n'))
+		if err != nil {
+			stream.EventErr("tracing.write", err)
+		}
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		stream.EventErr("tracing.post", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		stream.EventErrKv("tracing.post", fmt.Errorf("Error in HTTP request: %d", resp.StatusCode),
+			health.Kvs{"url": e.url})
+	}
+}
+
+// OTLP/JSON export request types
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// otlpExportRequest converts spans to an OTLP/JSON export request
+func otlpExportRequest(batch []*span) *otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            otlpStatus{Code: s.statusCode, Message: s.statusMessage},
+		}
+		if s.ParentSpanID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]interface{}{
+			"service.name":        traceServiceName,
+			"service.instance.id": health.Identifier,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: traceServiceName},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// otlpAttributes converts attributes to OTLP key values
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attributes))
+	for k, v := range attributes {
+		var value otlpAnyValue
+		switch v := v.(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			i := strconv.Itoa(v)
+			value.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(v, 10)
+			value.IntValue = &i
+		case float64:
+			value.DoubleValue = &v
+		default:
+			str := fmt.Sprint(v)
+			value.StringValue = &str
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: value})
+	}
+	return kvs
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamPool counts the connections and requests of the upstream transport.
+// http.Transport doesn't expose its pool, so connections are counted as
+// they're dialed and closed.
+type upstreamPool struct {
+	open       int64
+	inFlight   int64
+	dials      int64
+	dialErrors int64
+	reused     int64
+	fresh      int64
+}
+
+// upstreamPoolStats counts the connections of HTTPClient
+var upstreamPoolStats = &upstreamPool{}
+
+// newUpstreamTransport creates the transport for requests to relays, counting
+// its connections in stats
+func newUpstreamTransport(cfg UpstreamConfig, stats *upstreamPool) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(cfg.DialTimeout),
+		KeepAlive: time.Duration(cfg.KeepAlive),
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			atomic.AddInt64(&stats.dials, 1)
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				atomic.AddInt64(&stats.dialErrors, 1)
+				return nil, err
+			}
+			atomic.AddInt64(&stats.open, 1)
+			return &countedConn{Conn: conn, stats: stats}, nil
+		},
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		TLSHandshakeTimeout:   time.Duration(cfg.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout),
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout),
+	}
+}
+
+// countedConn is a connection that's uncounted when closed
+type countedConn struct {
+	net.Conn
+	stats *upstreamPool
+	once  sync.Once
+}
+
+// Close closes the connection
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.stats.open, -1)
+	})
+	return c.Conn.Close()
+}
+
+// begin counts a request as in flight until the returned func is called
+func (p *upstreamPool) begin() func() {
+	atomic.AddInt64(&p.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&p.inFlight, -1)
+	}
+}
+
+// recordConn counts whether a request got a pooled or a new connection
+func (p *upstreamPool) recordConn(reused bool) {
+	if reused {
+		atomic.AddInt64(&p.reused, 1)
+	} else {
+		atomic.AddInt64(&p.fresh, 1)
+	}
+}
+
+// upstreamPoolSnapshot is the state of the upstream pool at one point in time
+type upstreamPoolSnapshot struct {
+	OpenConns   int64 `json:"open_conns"`
+	IdleConns   int64 `json:"idle_conns"`
+	InFlight    int64 `json:"in_flight"`
+	Dials       int64 `json:"dials"`
+	DialErrors  int64 `json:"dial_errors"`
+	ReusedConns int64 `json:"reused_conns"`
+	NewConns    int64 `json:"new_conns"`
+}
+
+// snapshot returns the current statistics. Idle connections are estimated as
+// the open connections not serving a request.
+func (p *upstreamPool) snapshot() upstreamPoolSnapshot {
+	s := upstreamPoolSnapshot{
+		OpenConns:   atomic.LoadInt64(&p.open),
+		InFlight:    atomic.LoadInt64(&p.inFlight),
+		Dials:       atomic.LoadInt64(&p.dials),
+		DialErrors:  atomic.LoadInt64(&p.dialErrors),
+		ReusedConns: atomic.LoadInt64(&p.reused),
+		NewConns:    atomic.LoadInt64(&p.fresh),
+	}
+	s.IdleConns = s.OpenConns - s.InFlight
+	if s.IdleConns < 0 {
+		s.IdleConns = 0
+	}
+	return s
+}
+
+// emit emits the pool statistics as gauges
+func (p *upstreamPool) emit() {
+	s := p.snapshot()
+	job := stream.NewJob("upstream.pool")
+	job.Gauge("upstream.pool.open_conns", float64(s.OpenConns))
+	job.Gauge("upstream.pool.idle_conns", float64(s.IdleConns))
+	job.Gauge("upstream.pool.in_flight", float64(s.InFlight))
+	job.Gauge("upstream.pool.dials", float64(s.Dials))
+	job.Gauge("upstream.pool.dial_errors", float64(s.DialErrors))
+	job.Gauge("upstream.pool.reused_conns", float64(s.ReusedConns))
+	job.Gauge("upstream.pool.new_conns", float64(s.NewConns))
+}
+
+// poolStatsReporter emits the upstream pool statistics every interval
+type poolStatsReporter struct {
+	pool     *upstreamPool
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newPoolStatsReporter creates a poolStatsReporter for pool
+func newPoolStatsReporter(pool *upstreamPool, interval time.Duration) *poolStatsReporter {
+	return &poolStatsReporter{
+		pool:     pool,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins reporting in the background
+func (r *poolStatsReporter) Start() {
+	go r.loop()
+}
+
+// Stop stops reporting and waits for the reporter to finish
+func (r *poolStatsReporter) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *poolStatsReporter) loop() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.pool.emit()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// ServerTimingEnabled returns the upstream timing breakdown to the browser in
+// a Server-Timing header
+var ServerTimingEnabled = false
+
+// upstreamTiming is the breakdown of the time spent on an upstream request.
+// Phases that didn't happen, such as DNS for an ip or any dialing on a reused
+// connection, are zero.
+type upstreamTiming struct {
+	mu sync.Mutex
+
+	DNS     time.Duration `json:"dns"`
+	Connect time.Duration `json:"connect"`
+	TLS     time.Duration `json:"tls"`
+
+	// TTFB is the time from writing the request to the first response byte,
+	// that is the time the relay spent handling it
+	TTFB  time.Duration `json:"ttfb"`
+	Total time.Duration `json:"total"`
+
+	// Reused is set if the request was sent on a pooled connection
+	Reused bool `json:"reused"`
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+}
+
+// clientTrace returns an httptrace.ClientTrace that records into t
+func (t *upstreamTiming) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.DNS = time.Since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				return
+			}
+			t.mu.Lock()
+			t.Connect = time.Since(t.connectStart)
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.TLS = time.Since(t.tlsStart)
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.Reused = info.Reused
+			t.mu.Unlock()
+			upstreamPoolStats.recordConn(info.Reused)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			t.wroteRequest = time.Now()
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			if !t.wroteRequest.IsZero() {
+				t.TTFB = time.Since(t.wroteRequest)
+			}
+			t.mu.Unlock()
+		},
+	}
+}
+
+// emit emits each phase as a timing on the job along with whether the
+// connection was reused
+func (t *upstreamTiming) emit(job *health.Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.DNS > 0 {
+		job.Timing("proxy.upstream.dns", t.DNS.Nanoseconds())
+	}
+	if t.Connect > 0 {
+		job.Timing("proxy.upstream.connect", t.Connect.Nanoseconds())
+	}
+	if t.TLS > 0 {
+		job.Timing("proxy.upstream.tls", t.TLS.Nanoseconds())
+	}
+	if t.TTFB > 0 {
+		job.Timing("proxy.upstream.ttfb", t.TTFB.Nanoseconds())
+	}
+	job.EventKv("proxy.upstream.conn", health.Kvs{"reused": strconv.FormatBool(t.Reused)})
+}
+
+// serverTiming formats the breakdown as a Server-Timing header value
+func (t *upstreamTiming) serverTiming() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	metrics := []string{}
+	add := func(name string, d time.Duration, desc string) {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f;desc=%q", name, durationMs(d), desc))
+	}
+	if t.DNS > 0 {
+		add("dns", t.DNS, "DNS lookup")
+	}
+	if t.Connect > 0 {
+		add("connect", t.Connect, "TCP connect")
+	}
+	if t.TLS > 0 {
+		add("tls", t.TLS, "TLS handshake")
+	}
+	if t.TTFB > 0 {
+		add("relay", t.TTFB, "Relay processing")
+	}
+	add("upstream", t.Total, "Upstream total")
+
+	conn := "new"
+	if t.Reused {
+		conn = "reused"
+	}
+	metrics = append(metrics, "conn;desc="+strconv.Quote(conn))
+	return strings.Join(metrics, ", ")
+}
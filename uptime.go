@@ -0,0 +1,434 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// uptimeWindow is a rolling window over which availability is reported
+type uptimeWindow struct {
+	Name   string
+	length time.Duration
+
+	// modifier is the sqlite datetime modifier for the start of the window
+	modifier string
+}
+
+// uptimeWindows are the windows availability is reported over. The last
+// window is the longest and bounds how long probe results are kept.
+var uptimeWindows = []uptimeWindow{
+	{Name: "24h", length: 24 * time.Hour, modifier: "-24 hours"},
+	{Name: "7d", length: 7 * 24 * time.Hour, modifier: "-7 days"},
+	{Name: "30d", length: 30 * 24 * time.Hour, modifier: "-30 days"},
+}
+
+// availability summarizes probe results over a window
+type availability struct {
+	Probes    int64 `json:"probes"`
+	Reachable int64 `json:"reachable"`
+
+	// Percent is the share of the observed time the node was reachable,
+	// weighting each probe by the time until the next one, or nil if there
+	// were no probes in the window
+	Percent *float64 `json:"percent"`
+}
+
+// availabilityTally accumulates probe results, weighted by the time each one
+// stands for
+type availabilityTally struct {
+	probes    int64
+	reachable int64
+	observed  time.Duration
+	up        time.Duration
+}
+
+// add counts a probe result standing for weight
+func (t *availabilityTally) add(reachable bool, weight time.Duration) {
+	t.probes++
+	t.observed += weight
+	if reachable {
+		t.reachable++
+		t.up += weight
+	}
+}
+
+// merge adds the results of other
+func (t *availabilityTally) merge(other *availabilityTally) {
+	t.probes += other.probes
+	t.reachable += other.reachable
+	t.observed += other.observed
+	t.up += other.up
+}
+
+// availability returns the availability of the tallied results. Results
+// standing for no time at all, such as a single probe made just now, are
+// counted instead.
+func (t *availabilityTally) availability() availability {
+	a := availability{Probes: t.probes, Reachable: t.reachable}
+	switch {
+	case t.observed > 0:
+		percent := float64(t.up) / float64(t.observed) * 100
+		a.Percent = &percent
+	case t.probes > 0:
+		percent := float64(t.reachable) / float64(t.probes) * 100
+		a.Percent = &percent
+	}
+	return a
+}
+
+// outage is an interval during which consecutive probes of a node failed
+type outage struct {
+	Start time.Time `json:"start"`
+
+	// End is the time of the first successful probe after the outage, or nil
+	// if the outage is ongoing
+	End       *time.Time `json:"end"`
+	Probes    int64      `json:"probes"`
+	LastError string     `json:"last_error"`
+}
+
+// nodeUptime is the uptime report for a single node
+type nodeUptime struct {
+	IP           string                  `json:"ip"`
+	Availability map[string]availability `json:"availability"`
+	Outages      []outage                `json:"outages"`
+}
+
+// nodeAvailability is the availability of a single node in a fleet report
+type nodeAvailability struct {
+	IP           string                  `json:"ip"`
+	Availability map[string]availability `json:"availability"`
+}
+
+// fleetUptime is the uptime report for every node
+type fleetUptime struct {
+	Availability map[string]availability `json:"availability"`
+	Nodes        int                     `json:"nodes"`
+	NodesDown    int                     `json:"nodes_down"`
+	PerNode      []nodeAvailability      `json:"per_node"`
+}
+
+// recordProbe stores the result of fetching the status of the node at ip.
+// Errors are emitted on the given job before being returned.
+func recordProbe(job *health.Job, db *sql.DB, ip string, probeErr error) error {
+	errMsg := ""
+	if probeErr != nil {
+		errMsg = probeErr.Error()
+	}
+
+	_, err := db.Exec(`INSERT INTO probes (ip, reachable, error) VALUES (?, ?, ?);`, ip, probeErr == nil, errMsg)
+	if err != nil {
+		return job.EventErr("record_probe.execute", err)
+	}
+	return nil
+}
+
+// probeError is the most recent failed probe of a node
+type probeError struct {
+	Error    string    `json:"error"`
+	ProbedAt time.Time `json:"probed_at"`
+}
+
+// listLastProbeErrors returns the most recent failed probe of every node that
+// has one among the retained probe results, keyed by ip
+func listLastProbeErrors(db *sql.DB) (map[string]probeError, error) {
+	rows, err := db.Query(`SELECT ip, error, probed_at
+    FROM probes
+    WHERE id IN (SELECT MAX(id) FROM probes WHERE NOT reachable GROUP BY ip);`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	errs := map[string]probeError{}
+	for rows.Next() {
+		var (
+			ip string
+			e  probeError
+		)
+		err = rows.Scan(&ip, &e.Error, &e.ProbedAt)
+		if err != nil {
+			return nil, err
+		}
+		errs[ip] = e
+	}
+
+	return errs, rows.Err()
+}
+
+// pruneProbes deletes probe results older than the longest uptime window
+func pruneProbes(db *sql.DB) error {
+	longest := uptimeWindows[len(uptimeWindows)-1]
+	_, err := db.Exec(`DELETE FROM probes WHERE probed_at < datetime('now', ?);`, longest.modifier)
+	return err
+}
+
+// tallyAvailability tallies the probe results of the node at ip, or of every
+// node if ip is empty, by ip and window name. Each result stands for the time
+// until the node's next probe, or until now for the latest one, capped at
+// maxGap: the poller backs off from failing nodes, so counting probes would
+// understate outages.
+func tallyAvailability(db *sql.DB, ip string, maxGap time.Duration) (map[string]map[string]*availabilityTally, error) {
+	longest := uptimeWindows[len(uptimeWindows)-1]
+	rows, err := db.Query(`SELECT ip, reachable, probed_at
+    FROM probes
+    WHERE (? = '' OR ip = ?) AND probed_at >= datetime('now', ?)
+    ORDER BY ip, probed_at, id;`, ip, ip, longest.modifier)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	tallies := map[string]map[string]*availabilityTally{}
+	var (
+		prevIP        string
+		prevReachable bool
+		prevAt        time.Time
+		hasPrev       bool
+	)
+	// count adds the previous result, standing until the given time
+	count := func(until time.Time) {
+		weight := until.Sub(prevAt)
+		if weight < 0 {
+			weight = 0
+		}
+		if weight > maxGap {
+			weight = maxGap
+		}
+		if tallies[prevIP] == nil {
+			tallies[prevIP] = map[string]*availabilityTally{}
+		}
+		for _, w := range uptimeWindows {
+			if now.Sub(prevAt) > w.length {
+				continue
+			}
+			t, ok := tallies[prevIP][w.Name]
+			if !ok {
+				t = &availabilityTally{}
+				tallies[prevIP][w.Name] = t
+			}
+			t.add(prevReachable, weight)
+		}
+	}
+
+	for rows.Next() {
+		var (
+			probeIP   string
+			reachable bool
+			probedAt  time.Time
+		)
+		err = rows.Scan(&probeIP, &reachable, &probedAt)
+		if err != nil {
+			return nil, err
+		}
+		if hasPrev && probeIP == prevIP {
+			count(probedAt)
+		} else if hasPrev {
+			count(now)
+		}
+		prevIP, prevReachable, prevAt, hasPrev = probeIP, reachable, probedAt, true
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	if hasPrev {
+		count(now)
+	}
+
+	return tallies, nil
+}
+
+// getNodeUptime returns the availability and outages of the node at ip,
+// weighting probe results by up to maxGap each
+func getNodeUptime(db *sql.DB, ip string, maxGap time.Duration) (*nodeUptime, error) {
+	report := &nodeUptime{IP: ip, Availability: map[string]availability{}}
+
+	tallies, err := tallyAvailability(db, ip, maxGap)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range uptimeWindows {
+		t, ok := tallies[ip][w.Name]
+		if !ok {
+			t = &availabilityTally{}
+		}
+		report.Availability[w.Name] = t.availability()
+	}
+
+	outages, err := listOutages(db, ip)
+	if err != nil {
+		return nil, err
+	}
+	report.Outages = outages
+
+	return report, nil
+}
+
+// listOutages returns the outages of the node at ip that are covered by the
+// retained probe results, most recent first
+func listOutages(db *sql.DB, ip string) ([]outage, error) {
+	rows, err := db.Query(`SELECT reachable, error, probed_at
+    FROM probes
+    WHERE ip = ?
+    ORDER BY probed_at, id;`, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	outages := []outage{}
+	var current *outage
+	for rows.Next() {
+		var (
+			reachable bool
+			errMsg    string
+			probedAt  time.Time
+		)
+		err = rows.Scan(&reachable, &errMsg, &probedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if !reachable {
+			if current == nil {
+				current = &outage{Start: probedAt}
+			}
+			current.Probes++
+			current.LastError = errMsg
+			continue
+		}
+
+		if current != nil {
+			end := probedAt
+			current.End = &end
+			outages = append(outages, *current)
+			current = nil
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil {
+		outages = append(outages, *current)
+	}
+
+	// Most recent first
+	for i, j := 0, len(outages)-1; i < j; i, j = i+1, j-1 {
+		outages[i], outages[j] = outages[j], outages[i]
+	}
+
+	return outages, nil
+}
+
+// getFleetUptime returns the availability of every node and of the fleet as
+// a whole, weighting probe results by up to maxGap each
+func getFleetUptime(db *sql.DB, maxGap time.Duration) (*fleetUptime, error) {
+	report := &fleetUptime{Availability: map[string]availability{}, PerNode: []nodeAvailability{}}
+
+	ips, err := listNodeIPs(db)
+	if err != nil {
+		return nil, err
+	}
+	tallies, err := tallyAvailability(db, "", maxGap)
+	if err != nil {
+		return nil, err
+	}
+
+	// The fleet's availability includes nodes that have since been deleted
+	for _, w := range uptimeWindows {
+		fleet := &availabilityTally{}
+		for _, byWindow := range tallies {
+			if t, ok := byWindow[w.Name]; ok {
+				fleet.merge(t)
+			}
+		}
+		report.Availability[w.Name] = fleet.availability()
+	}
+
+	// A node is down if its most recent probe failed
+	err = db.QueryRow(`SELECT COUNT(*) FROM probes AS p
+    WHERE p.reachable = 0 AND p.id = (SELECT MAX(id) FROM probes WHERE ip = p.ip);`).Scan(&report.NodesDown)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		node := nodeAvailability{IP: ip, Availability: map[string]availability{}}
+		for _, w := range uptimeWindows {
+			t, ok := tallies[ip][w.Name]
+			if !ok {
+				t = &availabilityTally{}
+			}
+			node.Availability[w.Name] = t.availability()
+		}
+		report.PerNode = append(report.PerNode, node)
+	}
+	report.Nodes = len(ips)
+
+	return report, nil
+}
+
+// probePruner deletes probe results no uptime window covers anymore. It runs
+// on its own so probes recorded by browser requests are pruned even if the
+// poller is disabled.
+type probePruner struct {
+	db       *sql.DB
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newProbePruner creates a probePruner that prunes every interval
+func newProbePruner(db *sql.DB, interval time.Duration) *probePruner {
+	return &probePruner{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins pruning in the background
+func (p *probePruner) Start() {
+	go p.loop()
+}
+
+// Stop stops pruning and waits for the pruner to finish
+func (p *probePruner) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *probePruner) loop() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.prune()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune deletes expired probe results once
+func (p *probePruner) prune() {
+	job := stream.NewJob("probe_pruner.prune")
+	err := pruneProbes(p.db)
+	if err != nil {
+		job.EventErr("probe_pruner.prune", err)
+		job.Complete(health.Error)
+		return
+	}
+	job.Complete(health.Success)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gocraft/health"
+)
+
+// Webhook delivery statuses
+const (
+	webhookDeliveryPending   = "pending"
+	webhookDeliveryDelivered = "delivered"
+	webhookDeliveryFailed    = "failed"
+)
+
+// maxWebhookBackoff caps the delay between delivery attempts
+const maxWebhookBackoff = 24 * time.Hour
+
+// webhookEventNodeStateChanged is the event sent on node state transitions
+const webhookEventNodeStateChanged = "node.state_changed"
+
+// Webhook request headers
+const (
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookSubscription is an endpoint that receives node state transitions
+type webhookSubscription struct {
+	// Name identifies the subscription in the outbox. Defaults to the URL.
+	Name string `json:"name"`
+	URL  string `json:"url"`
+
+	// Secret is the HMAC-SHA256 key used to sign payloads
+	Secret string `json:"secret"`
+
+	// States limits deliveries to transitions into these states. All
+	// transitions are delivered if it's empty.
+	States []string `json:"states"`
+}
+
+// matches reports whether the subscription wants transitions into state
+func (s *webhookSubscription) matches(state string) bool {
+	if len(s.States) == 0 {
+		return true
+	}
+	for _, st := range s.States {
+		if st == state {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload is the body sent to webhook subscriptions
+type webhookPayload struct {
+	Event     string `json:"event"`
+	IP        string `json:"ip"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// webhookDelivery is an entry in the webhook outbox
+type webhookDelivery struct {
+	ID            int64     `json:"id"`
+	Subscription  string    `json:"subscription"`
+	Event         string    `json:"event"`
+	Payload       string    `json:"payload"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// webhookHTTPClient is the HTTP client used to deliver webhooks. Unlike
+// HTTPClient it verifies certificates. Requests time out after the live
+// upstream timeout.
+var webhookHTTPClient = &http.Client{}
+
+// webhookDispatcher queues node state transitions in a persistent outbox and
+// delivers them to subscriptions in the background, retrying failures with
+// exponential backoff
+type webhookDispatcher struct {
+	db          *sql.DB
+	interval    time.Duration
+	maxAttempts int
+	backoff     time.Duration
+
+	mu            sync.RWMutex
+	subscriptions []webhookSubscription
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newWebhookDispatcher creates a webhookDispatcher that checks the outbox every
+// interval and gives up on a delivery after maxAttempts
+func newWebhookDispatcher(db *sql.DB, subscriptions []webhookSubscription, interval time.Duration, maxAttempts int, backoff time.Duration) *webhookDispatcher {
+	return &webhookDispatcher{
+		db:            db,
+		subscriptions: subscriptions,
+		interval:      interval,
+		maxAttempts:   maxAttempts,
+		backoff:       backoff,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// parseWebhookSubscriptions parses a JSON list of webhook subscriptions
+func parseWebhookSubscriptions(s string) ([]webhookSubscription, error) {
+	subscriptions := []webhookSubscription{}
+	if s == "" {
+		return subscriptions, nil
+	}
+
+	err := json.Unmarshal([]byte(s), &subscriptions)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid webhook subscriptions: %s", err)
+	}
+
+	err = validateWebhookSubscriptions(subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// validateWebhookSubscriptions checks that every subscription has a url and
+// a secret and a unique name, defaulting names to the url
+func validateWebhookSubscriptions(subscriptions []webhookSubscription) error {
+	names := map[string]bool{}
+	for i := range subscriptions {
+		sub := &subscriptions[i]
+		if sub.URL == "" {
+			return fmt.Errorf("Webhook subscription %d has no url", i)
+		}
+		if sub.Secret == "" {
+			return fmt.Errorf("Webhook subscription %d has no secret", i)
+		}
+		if sub.Name == "" {
+			sub.Name = sub.URL
+		}
+		if names[sub.Name] {
+			return fmt.Errorf("Duplicate webhook subscription: %s", sub.Name)
+		}
+		names[sub.Name] = true
+	}
+
+	return nil
+}
+
+// Notify queues a delivery of the transition for every matching subscription
+// in tx, so deliveries are recorded together with the transition. Errors are
+// emitted on the given job before being returned.
+func (d *webhookDispatcher) Notify(job *health.Job, tx *sql.Tx, t *nodeStateTransition) error {
+	if t == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(&webhookPayload{
+		Event:     webhookEventNodeStateChanged,
+		IP:        t.IP,
+		From:      t.From,
+		To:        t.To,
+		Timestamp: t.At.Unix(),
+	})
+	if err != nil {
+		return job.EventErr("webhooks.marshal_payload", err)
+	}
+
+	for _, sub := range d.Subscriptions() {
+		if !sub.matches(t.To) {
+			continue
+		}
+
+		_, err = tx.Exec(`INSERT INTO webhook_deliveries (subscription, event, payload) VALUES (?, ?, ?);`,
+			sub.Name, webhookEventNodeStateChanged, string(payload))
+		if err != nil {
+			return job.EventErrKv("webhooks.enqueue", err, health.Kvs{"subscription": sub.Name})
+		}
+		job.EventKv("webhooks.enqueued", health.Kvs{"subscription": sub.Name, "ip": t.IP, "to": t.To})
+	}
+	return nil
+}
+
+// Start begins delivering in the background
+func (d *webhookDispatcher) Start() {
+	go d.loop()
+}
+
+// Stop signals the dispatcher to stop and waits for the current deliveries
+// to finish
+func (d *webhookDispatcher) Stop() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *webhookDispatcher) loop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.deliverDue()
+		}
+	}
+}
+
+// deliverDue attempts every pending delivery whose next attempt is due
+func (d *webhookDispatcher) deliverDue() {
+	deliveries, err := listDueWebhookDeliveries(d.db)
+	if err != nil {
+		stream.EventErr("webhooks.list_due", err)
+		return
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+
+	job := stream.NewJob("webhooks.deliver")
+	failed := false
+	for _, delivery := range deliveries {
+		select {
+		case <-d.stop:
+			job.Complete(health.Junk)
+			return
+		default:
+		}
+
+		err = d.deliver(job, delivery)
+		if err != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		job.Complete(health.Error)
+		return
+	}
+	job.Complete(health.Success)
+}
+
+// deliver sends a single delivery and records the outcome in the outbox
+func (d *webhookDispatcher) deliver(job *health.Job, delivery webhookDelivery) error {
+	kvs := health.Kvs{
+		"subscription": delivery.Subscription,
+		"delivery":     strconv.FormatInt(delivery.ID, 10),
+	}
+
+	err := d.send(delivery)
+	if err == nil {
+		_, err = d.db.Exec(`UPDATE webhook_deliveries
+      SET status = ?, attempts = attempts + 1, last_error = '', updated_at = CURRENT_TIMESTAMP
+      WHERE id = ?;`, webhookDeliveryDelivered, delivery.ID)
+		if err != nil {
+			return job.EventErrKv("webhooks.record_delivery", err, kvs)
+		}
+		job.EventKv("webhooks.delivered", kvs)
+		return nil
+	}
+	job.EventErrKv("webhooks.send", err, kvs)
+
+	// Retry with exponential backoff until we run out of attempts
+	attempts := delivery.Attempts + 1
+	status := webhookDeliveryPending
+	if attempts >= d.maxAttempts {
+		status = webhookDeliveryFailed
+	}
+	delay := backoffDelay(d.backoff, attempts-1, maxWebhookBackoff)
+
+	_, dbErr := d.db.Exec(`UPDATE webhook_deliveries
+    SET status = ?, attempts = ?, last_error = ?,
+      next_attempt_at = datetime('now', ?), updated_at = CURRENT_TIMESTAMP
+    WHERE id = ?;`,
+		status, attempts, err.Error(), fmt.Sprintf("+%d seconds", int64(delay/time.Second)), delivery.ID)
+	if dbErr != nil {
+		job.EventErrKv("webhooks.record_failure", dbErr, kvs)
+	}
+	return err
+}
+
+// send signs and POSTs the delivery's payload to its subscription
+func (d *webhookDispatcher) send(delivery webhookDelivery) error {
+	sub := d.subscription(delivery.Subscription)
+	if sub == nil {
+		return fmt.Errorf("Unknown webhook subscription: %s", delivery.Subscription)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), currentSettings().upstreamTimeout)
+	defer cancel()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(sub.Secret, timestamp, delivery.Payload))
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Error in HTTP request: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// subscription returns the subscription with the given name or nil
+func (d *webhookDispatcher) subscription(name string) *webhookSubscription {
+	for _, sub := range d.Subscriptions() {
+		if sub.Name == name {
+			return &sub
+		}
+	}
+	return nil
+}
+
+// Subscriptions returns the current subscriptions
+func (d *webhookDispatcher) Subscriptions() []webhookSubscription {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.subscriptions
+}
+
+// SetSubscriptions replaces the subscriptions. Pending deliveries to removed
+// subscriptions fail until they give up.
+func (d *webhookDispatcher) SetSubscriptions(subscriptions []webhookSubscription) {
+	d.mu.Lock()
+	d.subscriptions = subscriptions
+	d.mu.Unlock()
+}
+
+// signWebhookPayload returns the signature header value for the payload. The
+// signature is the hex encoded HMAC-SHA256 of "<timestamp>.<payload>".
+func signWebhookPayload(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliveryColumns are the columns scanned by scanWebhookDeliveries
+const webhookDeliveryColumns = `id, subscription, event, payload, status, attempts, last_error,
+      next_attempt_at, created_at, updated_at`
+
+// listDueWebhookDeliveries returns up to 100 pending deliveries whose next
+// attempt is due, oldest first
+func listDueWebhookDeliveries(db *sql.DB) ([]webhookDelivery, error) {
+	rows, err := db.Query(`SELECT `+webhookDeliveryColumns+`
+    FROM webhook_deliveries
+    WHERE status = ? AND next_attempt_at <= CURRENT_TIMESTAMP
+    ORDER BY id
+    LIMIT 100;`, webhookDeliveryPending)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// listWebhookDeliveries returns up to limit deliveries, newest first, with
+// the given status, or with any status if status is empty. If before isn't 0
+// only deliveries with a lower id are returned.
+func listWebhookDeliveries(db *sql.DB, status string, before int64, limit int) ([]webhookDelivery, error) {
+	rows, err := db.Query(`SELECT `+webhookDeliveryColumns+`
+    FROM webhook_deliveries
+    WHERE (? = '' OR status = ?) AND (? = 0 OR id < ?)
+    ORDER BY id DESC
+    LIMIT ?;`, status, status, before, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// scanWebhookDeliveries scans and closes rows of webhookDeliveryColumns
+func scanWebhookDeliveries(rows *sql.Rows) ([]webhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := []webhookDelivery{}
+	for rows.Next() {
+		var dl webhookDelivery
+		err := rows.Scan(&dl.ID, &dl.Subscription, &dl.Event, &dl.Payload, &dl.Status, &dl.Attempts,
+			&dl.LastError, &dl.NextAttemptAt, &dl.CreatedAt, &dl.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, dl)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Webhook replay errors
+var (
+	errWebhookDeliveryNotFound  = errors.New("Webhook delivery not found")
+	errWebhookDeliveryNotFailed = errors.New("Only failed webhook deliveries can be replayed")
+)
+
+// replayWebhookDelivery resets a failed delivery so it's attempted again
+// right away. Pending and delivered deliveries aren't replayed, so
+// subscribers don't get duplicates.
+func replayWebhookDelivery(db *sql.DB, id int64) error {
+	res, err := db.Exec(`UPDATE webhook_deliveries
+    SET status = ?, attempts = 0, next_attempt_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND status = ?;`, webhookDeliveryPending, id, webhookDeliveryFailed)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM webhook_deliveries WHERE id = ?);`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errWebhookDeliveryNotFailed
+	}
+	return errWebhookDeliveryNotFound
+}